@@ -6,12 +6,17 @@ import (
 	"net/http"
 	"net/rpc"
 	"server"
+	"shard"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"transport"
 )
 
 const (
 	TryConnect = 10
+	TryGroups  = 10
 )
 
 type agent struct {
@@ -19,6 +24,10 @@ type agent struct {
 	servers      []*rpc.Client
 	agentID      int
 	Port         string
+	clerk        *shard.Clerk // nil unless the cluster is sharded
+	transport    transport.Transport
+	lock         sync.Mutex // groups take one request of an agent at a time
+	requestID    int64      // the last RequestID handed out
 }
 
 func NewAgent(allHostPorts []string, agentID int, port string) (*agent, error) {
@@ -26,6 +35,7 @@ func NewAgent(allHostPorts []string, agentID int, port string) (*agent, error) {
 	a := &agent{}
 	a.allHostPorts = allHostPorts
 	a.agentID = agentID
+	a.requestID = time.Now().UnixNano()
 	a.Port = port
 	a.servers = make([]*rpc.Client, len(allHostPorts))
 
@@ -47,18 +57,67 @@ func NewAgent(allHostPorts []string, agentID int, port string) (*agent, error) {
 	return a, nil
 }
 
+// NewShardedAgent serves a sharded cluster: it asks the controllers which
+// replica group serves a key and sends the request there.
+func NewShardedAgent(controllers []string, agentID int, port string) (*agent, error) {
+	a := &agent{}
+	a.agentID = agentID
+	a.Port = port
+	a.requestID = time.Now().UnixNano()
+	a.transport = transport.NewTCPTransport()
+	a.clerk = shard.NewClerk(controllers, a.transport)
+	if _, err := a.clerk.Query(-1); err != nil {
+		a.transport.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// nextRequestID returns a RequestID above every one before it. Only the
+// first is taken from the clock, which may step back, and groups drop a
+// Put whose RequestID is not above the last one of the agent.
+func (a *agent) nextRequestID() int64 {
+	return atomic.AddInt64(&a.requestID, 1)
+}
+
+// call sends a request for key to one server, picked by requestID, of the
+// cluster or of the group that serves key.
+func (a *agent) call(serviceMethod string, key string, requestID int64, args interface{}, reply interface{}) error {
+	if a.clerk == nil {
+		return a.servers[requestID%int64(len(a.servers))].Call(serviceMethod, args, reply)
+	}
+	err := server.ErrWrongGroup
+	for i := 0; i < TryGroups; i++ {
+		if _, servers := a.clerk.Servers(key); len(servers) > 0 {
+			err = a.transport.Call(servers[requestID%int64(len(servers))], serviceMethod, args, reply)
+			if err == nil || (err.Error() != server.ErrWrongGroup.Error() && err.Error() != server.ErrMigrating.Error()) {
+				return err
+			}
+		}
+		// our config is old, the group has not caught up with it yet, or
+		// the shard is on its way to the group
+		time.Sleep(100 * time.Millisecond)
+		a.clerk.Query(-1)
+	}
+	return err
+}
+
 func (a *agent) GetHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Path[len("/Kiku/Get/"):]
-	timeStamp := time.Now().UnixNano()
-	callServer := timeStamp % int64(len(a.servers))
+	if a.clerk != nil {
+		// RequestIDs have to grow in the order the groups see them
+		a.lock.Lock()
+		defer a.lock.Unlock()
+	}
+	requestID := a.nextRequestID()
 
 	getArgs := &server.GetArgs{}
 	getArgs.AgentID = a.agentID
-	getArgs.RequestID = timeStamp
+	getArgs.RequestID = requestID
 	getArgs.Key = key
 
 	var getReply server.GetReply
-	error := a.servers[callServer].Call("Server.Get", getArgs, &getReply)
+	error := a.call("Server.Get", key, requestID, getArgs, &getReply)
 
 	if error == nil && getReply.OK {
 		fmt.Fprint(w, getReply.Value)
@@ -73,17 +132,20 @@ func (a *agent) PutHandler(w http.ResponseWriter, r *http.Request) {
 	kvpair := strings.Split(remPartOfURL, "&")
 	key := kvpair[0]
 	value := kvpair[1]
-	timeStamp := time.Now().UnixNano()
-	callServer := timeStamp % int64(len(a.servers))
+	if a.clerk != nil {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+	}
+	requestID := a.nextRequestID()
 
 	putArgs := &server.PutArgs{}
 	putArgs.AgentID = a.agentID
-	putArgs.RequestID = timeStamp
+	putArgs.RequestID = requestID
 	putArgs.Key = key
 	putArgs.Value = value
 
 	var putReply server.PutReply
-	error := a.servers[callServer].Call("Server.Put", putArgs, &putReply)
+	error := a.call("Server.Put", key, requestID, putArgs, &putReply)
 
 	if error == nil && putReply.OK {
 		fmt.Fprint(w, "OK")
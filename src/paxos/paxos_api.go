@@ -1,8 +1,22 @@
 package paxos
 
+import "context"
+
+// Paxos agrees on opaque values: it stores and ships the bytes it is given
+// and never looks inside them.
 type Paxos interface {
-	StartPaxos(rid int, op interface{})
-	GetLog(rid int) (bool, interface{})
+	StartPaxos(rid int, op []byte)
+	Decide(ctx context.Context, rid int, op []byte) ([]byte, error)
+	Wait(ctx context.Context, rid int) ([]byte, error)
+	GetLog(rid int) (bool, []byte)
+	Status(rid int) (Fate, []byte)
+	Subscribe(from int) <-chan Decision
 	CommitFinished(opID int)
+	MaxID() int
+	MinID() int
+	Watermarks() map[string]int
+	ReadIndex() (int, bool)
+	Reconfigure(from int, members []string) error
+	Stats() Stats
 	Close()
 }
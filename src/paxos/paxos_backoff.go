@@ -0,0 +1,52 @@
+package paxos
+
+import "math"
+import "time"
+
+// how long a proposer waits after its first failed round, and the most
+// it waits after many, unless Config.Backoff and Config.MaxBackoff say
+// otherwise
+const (
+	DefaultBackoff    = 10 * time.Millisecond
+	DefaultMaxBackoff = 500 * time.Millisecond
+)
+
+// backoff is how long to wait after the given number of failed rounds:
+// somewhere between half and all of Backoff doubled that many times, so
+// proposers that failed together do not come back together.
+func (px *paxos) backoff(attempt int) time.Duration {
+	d := px.maxBackoff
+	if attempt < 32 && px.baseBackoff<<uint(attempt) < px.maxBackoff {
+		d = px.baseBackoff << uint(attempt)
+	}
+	px.randLock.Lock()
+	defer px.randLock.Unlock()
+	return d/2 + time.Duration(px.random.Int63n(int64(d/2)+1))
+}
+
+// noteRival remembers the highest ballot this acceptor promised or
+// accepted for another proposer, and the instances it was for. The
+// caller holds phaseLock.
+func (px *paxos) noteRival(args *PaxosAgrs) {
+	if args.Self == px.self || args.Pid.Less(px.rival) {
+		return
+	}
+	px.rival = args.Pid
+	px.rivalFrom, px.rivalTo = args.Rid, args.Rid
+	if args.Multi {
+		px.rivalTo = math.MaxInt32
+	}
+	px.rivalSeen = px.clock.Now()
+}
+
+// deferTo tells whether a proposer with a ballot above tried is still at
+// work on opID; it is better to let it finish than to preempt it.
+// Activity older than MaxBackoff does not count, so a proposer that died
+// is only waited for once.
+func (px *paxos) deferTo(opID int, tried Ballot) bool {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	return px.rival.Greater(tried) && px.rival.Node != px.self &&
+		px.rivalFrom <= opID && opID <= px.rivalTo &&
+		px.clock.Now().Sub(px.rivalSeen) < px.maxBackoff
+}
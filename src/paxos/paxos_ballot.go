@@ -0,0 +1,37 @@
+package paxos
+
+// Ballot is a proposal number. Rounds are compared first and the proposing
+// node breaks ties, so two nodes never send the same ballot.
+type Ballot struct {
+	Round int
+	Node  int
+}
+
+// NilBallot is lower than any ballot a proposer can send.
+var NilBallot = Ballot{-1, -1}
+
+func (b Ballot) Less(other Ballot) bool {
+	if b.Round != other.Round {
+		return b.Round < other.Round
+	}
+	return b.Node < other.Node
+}
+
+func (b Ballot) Greater(other Ballot) bool {
+	return other.Less(b)
+}
+
+// Next returns the smallest ballot owned by node that is higher than b.
+func (b Ballot) Next(node int) Ballot {
+	if b.Node < node {
+		return Ballot{b.Round, node}
+	}
+	return Ballot{b.Round + 1, node}
+}
+
+func maxBallot(a Ballot, b Ballot) Ballot {
+	if a.Less(b) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,192 @@
+package paxos
+
+import "sort"
+import "time"
+
+// how often a node resends missed Commits and looks for gaps in its log
+const catchUpInterval = 100 * time.Millisecond
+
+// decided values moved by one Fetch or one round of resent Commits
+const fetchLimit = 100
+
+// sendCommit tells one peer about a decision, and remembers it for
+// catchUp if the peer could not be reached. At most fetchLimit Commits
+// are kept per peer, and none across a restart; a peer that misses more
+// finds the rest through fetchDecided.
+func (px *paxos) sendCommit(node int, args *PaxosAgrs) {
+	if px.rpcCall(px.address(node), "Paxos.Commit", args, &PaxosReply{}) {
+		return
+	}
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	if px.missed[node] == nil {
+		px.missed[node] = make(map[int]bool)
+	}
+	if len(px.missed[node]) < fetchLimit {
+		px.missed[node][args.Rid] = true
+	}
+}
+
+// catchUp runs for the life of the node. It pushes decisions to peers
+// that missed them and pulls decisions this node missed, so a node back
+// from a partition reaches the log head without proposing anything.
+func (px *paxos) catchUp() {
+	for px.sleep(px.ctx, catchUpInterval) {
+		// peers in order, so a simulated run replays the same way
+		resend := px.missedCommits()
+		nodes := []int{}
+		for node := range resend {
+			nodes = append(nodes, node)
+		}
+		sort.Ints(nodes)
+		for _, node := range nodes {
+			px.resendCommits(node, resend[node])
+		}
+		px.fetchDecided()
+	}
+}
+
+// missedCommits returns, per peer, the Commits to resend this round.
+func (px *paxos) missedCommits() map[int][]*PaxosAgrs {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+
+	resend := make(map[int][]*PaxosAgrs)
+	appliers := px.appliers()
+	minID := px.minID()
+	for node, opIDs := range px.missed {
+		if !contains(appliers, node) {
+			// it left the cluster and does not need them anymore
+			delete(px.missed, node)
+			continue
+		}
+		ids := []int{}
+		for opID := range opIDs {
+			if opID < minID {
+				delete(opIDs, opID)
+			} else {
+				ids = append(ids, opID)
+			}
+		}
+		if len(ids) == 0 {
+			delete(px.missed, node)
+			continue
+		}
+		sort.Ints(ids)
+		if len(ids) > fetchLimit {
+			ids = ids[:fetchLimit]
+		}
+		for _, opID := range ids {
+			operation := px.ops[opID]
+			args := &PaxosAgrs{opID, operation.n_a, px.maxNodeDone[px.self], px.self, operation.v_a, false}
+			resend[node] = append(resend[node], args)
+		}
+	}
+	return resend
+}
+
+// resendCommits tries the first Commit alone, so an unreachable peer
+// costs one timeout per round, then sends the rest at once and waits for
+// them, so Close waits for them too.
+func (px *paxos) resendCommits(node int, args []*PaxosAgrs) {
+	address := px.address(node)
+	if !px.rpcCall(address, "Paxos.Commit", args[0], &PaxosReply{}) {
+		return
+	}
+	delivered := make(chan int, len(args))
+	delivered <- args[0].Rid
+	for _, a := range args[1:] {
+		a := a
+		px.spawn(func() {
+			if px.rpcCall(address, "Paxos.Commit", a, &PaxosReply{}) {
+				delivered <- a.Rid
+			} else {
+				delivered <- -1
+			}
+		})
+	}
+	for range args {
+		if opID := <-delivered; opID >= 0 {
+			px.phaseLock.Lock()
+			delete(px.missed[node], opID)
+			px.phaseLock.Unlock()
+		}
+	}
+}
+
+// fetchDecided asks peers for decided values once this node has been
+// behind for a whole round: its first undecided instance is below one it
+// has heard of, or below the done watermark of a peer. Lags that short
+// are normal while instances run concurrently.
+func (px *paxos) fetchDecided() {
+	from, known := px.gap()
+	if from > known || from != px.lagFrom {
+		px.lagFrom = from
+		return
+	}
+	peers := px.learners(from)
+	for tries := 0; tries < len(peers) && from <= known; {
+		node := peers[(from+tries)%len(peers)]
+		reply := &FetchReply{}
+		if node == px.self || !px.rpcCall(px.address(node), "Paxos.Fetch", &FetchArgs{from}, reply) {
+			tries++
+			continue
+		}
+		px.phaseLock.Lock()
+		for opID, v_a := range reply.Decided {
+			px.learn(opID, v_a)
+		}
+		px.phaseLock.Unlock()
+		next, highest := px.gap()
+		if next == from {
+			// this peer is missing it too
+			tries++
+		}
+		from, known = next, highest
+	}
+	px.lagFrom = from
+}
+
+// gap returns the first instance this node has not seen decided, and the
+// highest one it knows to be decided somewhere.
+func (px *paxos) gap() (int, int) {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+
+	from := max(px.minID(), px.maxNodeDone[px.self]+1)
+	for {
+		operation, found := px.ops[from]
+		if !found || !operation.commited {
+			break
+		}
+		from++
+	}
+	known := -1
+	for opID, operation := range px.ops {
+		if operation.commited {
+			known = max(known, opID)
+		}
+	}
+	// every message of a peer carries its watermark, which only covers
+	// instances it has seen decided
+	for node, done := range px.maxNodeDone {
+		if node != px.self {
+			known = max(known, done)
+		}
+	}
+	return from, known
+}
+
+// Fetch returns the decided values this node has for instances >= args.From.
+func (px *paxos) Fetch(args *FetchArgs, reply *FetchReply) error {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+
+	reply.Decided = make(map[int][]byte)
+	for opID, operation := range px.ops {
+		if opID >= args.From && opID < args.From+fetchLimit && operation.commited {
+			reply.Decided[opID] = operation.v_a
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package paxos
+
+import "context"
+import "errors"
+import "time"
+
+var ErrClosed = errors.New("paxos: node closed")
+var ErrForgotten = errors.New("paxos: instance forgotten")
+
+// Decide proposes v_a for instance rid and waits for the value decided
+// there, which need not be v_a. If ctx ends first this node gives up on
+// its proposal and Decide returns the error of ctx; if the node is closed
+// first, ErrClosed.
+func (px *paxos) Decide(ctx context.Context, rid int, v_a []byte) ([]byte, error) {
+	ctx, cancel := px.bind(ctx)
+	defer cancel()
+	px.phaseLock.Lock()
+	if !px.closed && px.minID() <= rid && !px.findOperation(rid).commited && !px.proposing[rid] {
+		px.proposing[rid] = true
+		px.counters.add(&px.counters.stats.ProposalsStarted, 1)
+		px.spawn(func() { px.Propose(ctx, rid, v_a) })
+	}
+	px.phaseLock.Unlock()
+	return px.Wait(ctx, rid)
+}
+
+// Wait waits until instance rid is decided here and returns its value,
+// without proposing anything.
+func (px *paxos) Wait(ctx context.Context, rid int) ([]byte, error) {
+	for {
+		px.phaseLock.Lock()
+		changed := px.changed
+		fate, v_a := Pending, []byte(nil)
+		if rid < px.minID() {
+			fate = Forgotten
+		} else if operation, found := px.ops[rid]; found && operation.commited {
+			fate, v_a = Decided, operation.v_a
+		}
+		px.phaseLock.Unlock()
+
+		switch fate {
+		case Decided:
+			return v_a, nil
+		case Forgotten:
+			return nil, ErrForgotten
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-px.ctx.Done():
+			return nil, ErrClosed
+		}
+	}
+}
+
+// bind returns a context that also ends when the node is closed.
+func (px *paxos) bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(px.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// spawn runs f in a goroutine that Close waits for. The caller either
+// holds phaseLock and has checked that the node is not closed, or runs in
+// a goroutine spawn started, which Close is still waiting for.
+func (px *paxos) spawn(f func()) {
+	px.running.Add(1)
+	go func() {
+		defer px.running.Done()
+		f()
+	}()
+}
+
+// sleep waits for d, and reports false if ctx ended first.
+func (px *paxos) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-px.clock.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,25 +1,101 @@
 package paxos
 
+import "context"
 import "net"
 import "net/rpc"
-//import "log"
+import "sim"
+import "transport"
+import "log"
+import "os"
+import "strings"
 import "sync"
 import "time"
 import "math/rand"
+import "sync/atomic"
 
 type paxos struct {
-	phaseLock           sync.Mutex
-	listen              net.Listener
-	closed              bool
-	nodes               []string
-	self                int
-	ops                 map[int]Operation
-	maxNodeDone         map[int]int
-	proposeLock         sync.Mutex
-	callbackConnections map[string]*rpc.Client
-	isDebug             bool
+	phaseLock    sync.Mutex
+	listen       net.Listener
+	conns        map[net.Conn]bool
+	closed       bool
+	nodes        []string // every node ever added, indexed by node id
+	memberships  []Membership
+	self         int
+	ops          map[int]Operation
+	maxNodeDone  map[int]int
+	proposing    map[int]bool // instances this node is driving right now
+	prepareLock  sync.Mutex
+	window       chan struct{} // bounds how many of them run at once
+	transport    transport.Transport
+	ownTransport bool
+	quorum       QuorumSystem
+	nonVoting    []int // learners: they get every decision but never vote
+	isDebug      bool
+	random       *rand.Rand // guarded by randLock
+	randLock     sync.Mutex
+	clock        sim.Clock
+	rpcTimeout   time.Duration
+	rpcCount     int32
+	counters     *counters
+	tracer       Tracer
+	name         string  // nodes[self], for traces
+	traced       []Event // events the tracer has yet to get, guarded by traceLock
+	traceLock    sync.Mutex
+	traceReady   chan struct{} // tells emit that traced is not empty
+
+	// acceptor side of Multi-Paxos: a promise covering every instance >= rangeFrom
+	rangeFrom int
+	rangeN    Ballot
+
+	// proposer side of Multi-Paxos: set while this node holds a range promise
+	// from a majority and may skip Prepare for instances >= leaderFrom
+	leading      bool
+	leaderPid    Ballot
+	leaderFrom   int
+	leaderValues map[int]Proposal
+
+	store    Store
+	appended int // records appended since the store was last rewritten
+
+	// learner catch-up: instances whose Commit a peer did not get, and the
+	// first undecided instance seen on the last catch-up tick
+	missed  map[int]map[int]bool
+	lagFrom int
+
+	changed chan struct{}      // closed and replaced whenever an instance is decided here
+	ctx     context.Context    // ends with Close, and with it every goroutine of the node
+	cancel  context.CancelFunc // called by Close
+	running sync.WaitGroup     // the goroutines Close waits for
+
+	// leader leases: the leader answers reads alone until leaseUntil, and
+	// as an acceptor this node refuses every proposer but grantHolder
+	// until grantUntil
+	lease       time.Duration
+	drift       float64
+	leasePid    Ballot
+	leaseUntil  time.Time
+	grantHolder int
+	grantUntil  time.Time
+
+	// dueling proposers: failed rounds back off, and the highest ballot
+	// another proposer got from this acceptor is let finish its instances
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	rival       Ballot
+	rivalFrom   int
+	rivalTo     int
+	rivalSeen   time.Time
 }
 
+// instances a node may drive at once unless Config.Window says otherwise
+const DefaultWindow = 16
+
+// how long a single RPC may take unless Config.RPCTimeout says otherwise
+const DefaultRPCTimeout = 500 * time.Millisecond
+
+// rewrite the store once this many records pile up behind garbage-collected instances
+const compactThreshold = 1000
+
 func max(a int, b int) int {
 	if a > b {
 		return a
@@ -38,143 +114,387 @@ func min(a int, b int) int {
 // major funcions
 
 func NewPaxos(nodes []string, self int, rpcs *rpc.Server, isDebug bool) *paxos {
+	return NewPaxosWithConfig(nodes, self, rpcs, &Config{IsDebug: isDebug})
+}
+
+func NewPaxosWithConfig(nodes []string, self int, rpcs *rpc.Server, config *Config) *paxos {
 	px := &paxos{
-		nodes:               nodes,
-		self:                self,
-		ops:                 make(map[int]Operation),
-		maxNodeDone:         make(map[int]int),
-		callbackConnections: make(map[string]*rpc.Client),
-		isDebug:             isDebug,
-	}
-	for i, _ := range px.nodes {
+		nodes:        nodes,
+		self:         self,
+		ops:          make(map[int]Operation),
+		conns:        make(map[net.Conn]bool),
+		proposing:    make(map[int]bool),
+		maxNodeDone:  make(map[int]int),
+		transport:    config.Transport,
+		quorum:       config.Quorum,
+		isDebug:      config.IsDebug,
+		clock:        config.Clock,
+		store:        config.Store,
+		rangeFrom:    -1,
+		rangeN:       NilBallot,
+		leaderPid:    NilBallot,
+		rival:        NilBallot,
+		leaderValues: make(map[int]Proposal),
+		missed:       make(map[int]map[int]bool),
+		lagFrom:      -1,
+		counters:     newCounters(),
+		tracer:       config.Tracer,
+		name:         nodes[self],
+		traceReady:   make(chan struct{}, 1),
+		changed:      make(chan struct{}),
+	}
+	members := []int{}
+	voters := []string{}
+	for i, node := range px.nodes {
 		px.maxNodeDone[i] = -1
+		if len(intersect(config.Learners, []string{node})) > 0 {
+			px.nonVoting = append(px.nonVoting, i)
+		} else {
+			members = append(members, i)
+			voters = append(voters, node)
+		}
+	}
+	px.memberships = []Membership{{0, members}}
+	if px.quorum == nil {
+		px.quorum = Majority{}
+	}
+	if err := px.quorum.Validate(voters); err != nil {
+		log.Println("unsafe quorum system: ", err)
+		return nil
+	}
+	if px.clock == nil {
+		px.clock = sim.Wall
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	px.random = rand.New(rand.NewSource(seed))
+	px.lease = config.Lease
+	px.drift = config.Drift
+	if px.drift <= 0 {
+		px.drift = DefaultDrift
+	}
+	if px.lease > 0 {
+		// grants made before a restart are forgotten, so keep out every
+		// proposer for as long as one of them could still be running
+		px.grantHolder = -1
+		px.grantUntil = px.clock.Now().Add(px.lease)
+	}
+	px.baseBackoff = config.Backoff
+	if px.baseBackoff <= 0 {
+		px.baseBackoff = DefaultBackoff
+	}
+	px.maxBackoff = config.MaxBackoff
+	if px.maxBackoff <= 0 {
+		px.maxBackoff = DefaultMaxBackoff
+	}
+	if px.maxBackoff < px.baseBackoff {
+		px.maxBackoff = px.baseBackoff
+	}
+	window := config.Window
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	px.window = make(chan struct{}, window)
+	px.rpcTimeout = config.RPCTimeout
+	if px.rpcTimeout <= 0 {
+		px.rpcTimeout = DefaultRPCTimeout
+	}
+	if px.transport == nil {
+		px.transport = transport.Default(nodes[self])
+		px.ownTransport = true
+	}
+	if px.store != nil {
+		records, err := px.store.Load()
+		if err != nil {
+			return nil
+		}
+		px.replay(records)
+	}
+
+	px.ctx, px.cancel = context.WithCancel(context.Background())
+	if rpcs != nil {
+		rpcs.RegisterName("Paxos", Wrap(px))
+		px.spawn(px.catchUp)
+		px.spawn(px.emit)
+		return px
 	}
 
-	// if rpcs != nil {
+	// standalone peer: serve our own rpc.Server on nodes[self]
+	rpcs = rpc.NewServer()
 	rpcs.RegisterName("Paxos", Wrap(px))
-	// } else {
-	// 	rpcs = rpc.NewServer()
-	// 	rpcs.RegisterName("Paxos", Wrap(px))
-
-	// 	l, err := net.Listen("tcp", ":"+nodes[self])
-	// 	if err != nil {
-	// 		log.Fatal("listen error: ", err)
-	// 		return nil
-	// 	}
-	// 	px.listen = l
-	// 	go func() {
-	// 		for px.closed == false {
-	// 			conn, err := px.listen.Accept()
-	// 			if err == nil && px.closed == false {
-	// 				go rpcs.ServeConn(conn)
-	// 			} else if err == nil {
-	// 				conn.Close()
-	// 			}
-	// 		}
-	// 	}()
-	// }
+	if strings.Contains(nodes[self], "/") {
+		// stale Unix socket left behind by an earlier run; as in
+		// transport.Default, only paths are sockets
+		os.Remove(nodes[self])
+	}
+	l, err := px.transport.Listen(nodes[self])
+	if err != nil {
+		log.Println("listen error: ", err)
+		return nil
+	}
+	px.listen = l
+	px.spawn(func() {
+		for !px.isClosed() {
+			conn, err := px.listen.Accept()
+			px.phaseLock.Lock()
+			if err == nil && !px.closed {
+				px.conns[conn] = true
+				go rpcs.ServeConn(conn)
+			} else if err == nil {
+				conn.Close()
+			}
+			px.phaseLock.Unlock()
+		}
+	})
+	px.spawn(px.catchUp)
+	px.spawn(px.emit)
 	return px
 }
 
-func (px *paxos) StartPaxos(opID int, v_a interface{}) {
+func (px *paxos) StartPaxos(opID int, v_a []byte) {
 	px.phaseLock.Lock()
 	defer px.phaseLock.Unlock()
 
-	if px.MinID() <= opID {
+	if px.minID() <= opID && !px.closed {
 		opertaion := px.findOperation(opID)
-		if opertaion.commited {
+		if opertaion.commited || px.proposing[opID] {
 			return
 		}
-		go px.Propose(opID, v_a)
+		px.proposing[opID] = true
+		px.counters.add(&px.counters.stats.ProposalsStarted, 1)
+		px.spawn(func() { px.Propose(px.ctx, opID, v_a) })
 	} else {
 	}
 	return
 }
 
-func (px *paxos) GetLog(opID int) (bool, interface{}) {
+func (px *paxos) GetLog(opID int) (bool, []byte) {
 	px.phaseLock.Lock()
 	defer px.phaseLock.Unlock()
 
-	if px.MinID() <= opID {
+	if px.minID() <= opID {
 		operation := px.findOperation(opID)
 		return operation.commited, operation.v_a
 	}
 	return false, nil
 }
 
-func (px *paxos) Propose(opID int, v_a interface{}) {
-	px.proposeLock.Lock()
-	defer px.proposeLock.Unlock()
+// Propose drives instance opID until it is decided or ctx ends.
+func (px *paxos) Propose(ctx context.Context, opID int, v_a []byte) {
+	defer func() {
+		px.phaseLock.Lock()
+		delete(px.proposing, opID)
+		px.phaseLock.Unlock()
+	}()
+	select {
+	case px.window <- struct{}{}:
+		defer func() { <-px.window }()
+	case <-ctx.Done():
+		return
+	}
 
-	proposalNumber := -1
-	nextProposal := -1
+	proposalNumber := NilBallot
+	nextProposal := NilBallot
+	tried := NilBallot
 	self := px.self
+	started := px.clock.Now()
+	rounds := 0
 	completed := false
-	for !completed {
-		nextProposal += 1
-		proposalNumber = nextProposal
-		indicator := len(px.nodes) / 2
-		prepareAgreeCount := 0
-		maxProposal := -1
-		maxProposalValue := v_a
-
-		paxosAgrs := &PaxosAgrs{opID, proposalNumber, px.maxNodeDone[self], self, nil}
-		for _, node := range px.nodes {
-			paxosReply := &PaxosReply{}
-			if node == px.nodes[self] {
-				px.Prepare(paxosAgrs, paxosReply)
-			} else {
-				hasNoErr := px.rpcCall(node, "Paxos.Prepare", paxosAgrs, paxosReply)
-				if !hasNoErr {
-					continue
-				}
+	for attempt := 0; !completed && ctx.Err() == nil; attempt++ {
+		if decided, decidedValue := px.GetLog(opID); decided {
+			// the outcome is known already (maybe from a promise), just spread it
+			px.commitAll(&PaxosAgrs{opID, proposalNumber, px.doneOf(self), self, decidedValue, false})
+			px.counters.decided(rounds, px.clock.Now().Sub(started))
+			break
+		}
+		voters := px.voters(opID)
+		value := v_a
+		leading := false
+		holder := ""
+		proposalNumber, value, leading = px.leaderProposal(opID, v_a)
+		if !leading && px.deferTo(opID, tried) {
+			// a higher ballot is still at work on this instance, let it finish
+			px.sleep(ctx, px.backoff(attempt))
+			continue
+		}
+		if !leading {
+			// one instance at a time runs Phase 1, the ones waiting
+			// behind it usually find this node leading afterwards
+			ok := false
+			px.prepareLock.Lock()
+			proposalNumber, value, ok = px.leaderProposal(opID, v_a)
+			if !ok {
+				// full Prepare, which also tries to take over as distinguished proposer
+				nextProposal = maxBallot(nextProposal, px.highestPromise()).Next(self)
+				proposalNumber = nextProposal
+				tried = proposalNumber
+				value, ok, nextProposal, holder = px.preparePhase(opID, proposalNumber, v_a)
 			}
-			if paxosReply.OK {
-				prepareAgreeCount++
-				if paxosReply.N_a > maxProposal {
-					maxProposal = paxosReply.N_a
-					maxProposalValue = paxosReply.V_a
-				}
-			} else {
-				nextProposal = max(nextProposal, paxosReply.N_h)
+			px.prepareLock.Unlock()
+			if !ok {
+				// a round that never got to Accept
+				rounds++
+			}
+			if !ok && holder != "" && holder != px.address(self) {
+				// a leader holds a lease and nobody else gets to propose
+				px.forward(ctx, holder, opID, v_a)
+				continue
+			}
+			if !ok {
+				px.sleep(ctx, px.backoff(attempt))
+				continue
 			}
 		}
-		acceptAgreeCount := 0
-		paxosAgrs.V_a = maxProposalValue
-
-		if prepareAgreeCount > indicator {
-
-			for _, node := range px.nodes {
-				paxosReply := &PaxosReply{}
-				if node == px.nodes[self] {
-					px.Accept(paxosAgrs, paxosReply)
-				} else {
-					hasNoErr := px.rpcCall(node, "Paxos.Accept", paxosAgrs, paxosReply)
-					if !hasNoErr {
-						continue
-					}
-				}
-				if paxosReply.OK {
-					acceptAgreeCount++
-				} else {
-					nextProposal = max(nextProposal, paxosReply.N_h)
-				}
+		paxosAgrs := &PaxosAgrs{opID, proposalNumber, px.doneOf(self), self, value, false}
+		rounds++
+
+		accepts := newTally(px.quorum, 2, px.addresses(voters))
+		for _, voter := range px.addresses(voters) {
+			px.trace(EventAccept, opID, proposalNumber, voter)
+		}
+		responses := px.broadcast("Paxos.Accept", paxosAgrs, voters)
+		for accepts.open() {
+			response := <-responses
+			accepts.record(px.address(response.node), response.ok && response.reply.OK)
+			if response.ok && !response.reply.OK {
+				px.counters.add(&px.counters.stats.AcceptRejections, 1)
+				nextProposal = maxBallot(nextProposal, response.reply.N_h)
 			}
 		}
-		if acceptAgreeCount > indicator {
-			for _, node := range px.nodes {
-				paxosReply := &PaxosReply{}
-				if node == px.nodes[self] {
-					px.Commit(paxosAgrs, paxosReply)
-				} else {
-					px.rpcCall(node, "Paxos.Commit", paxosAgrs, paxosReply)
+		if accepts.reached() {
+			px.commitAll(paxosAgrs)
+			px.counters.decided(rounds, px.clock.Now().Sub(started))
+			completed = true
+		} else {
+			// another proposer showed up, go back to running Prepare
+			px.stepDown(proposalNumber)
+			px.sleep(ctx, px.backoff(attempt))
+		}
+	}
+}
+
+// commitAll records the decision here and tells the peers without
+// waiting for them.
+func (px *paxos) commitAll(paxosAgrs *PaxosAgrs) {
+	px.Commit(paxosAgrs, &PaxosReply{})
+	for _, i := range px.learners(paxosAgrs.Rid) {
+		if i != px.self {
+			i := i
+			px.spawn(func() { px.sendCommit(i, paxosAgrs) })
+		}
+	}
+}
+
+// preparePhase runs Phase 1 for every instance >= opID. On success this node
+// becomes the distinguished proposer and later instances only need Accept.
+// If a lease keeps it out, it also returns the address of the lease holder.
+func (px *paxos) preparePhase(opID int, proposalNumber Ballot, v_a []byte) ([]byte, bool, Ballot, string) {
+	self := px.self
+	voters := px.voters(opID)
+	nextProposal := proposalNumber
+	promises := make(map[int]Proposal)
+	holder := ""
+
+	prepares := newTally(px.quorum, 1, px.addresses(voters))
+	paxosAgrs := &PaxosAgrs{opID, proposalNumber, px.doneOf(self), self, nil, true}
+	for _, voter := range px.addresses(voters) {
+		px.trace(EventPrepare, opID, proposalNumber, voter)
+	}
+	responses := px.broadcast("Paxos.Prepare", paxosAgrs, voters)
+	for prepares.open() {
+		response := <-responses
+		paxosReply := response.reply
+		prepares.record(px.address(response.node), response.ok && paxosReply.OK)
+		if response.ok && paxosReply.OK {
+			for id, accepted := range paxosReply.Accepted {
+				known, found := promises[id]
+				if !found || (!known.Commited && (accepted.Commited || accepted.N_a.Greater(known.N_a))) {
+					promises[id] = accepted
 				}
 			}
-			completed = true
+		} else if response.ok {
+			px.counters.add(&px.counters.stats.PrepareRejections, 1)
+			nextProposal = maxBallot(nextProposal, paxosReply.N_h)
+			if paxosReply.LeaseHolder != "" {
+				holder = paxosReply.LeaseHolder
+			}
+		}
+	}
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	// a decided value is final, whoever reported it; this is how a node
+	// catches up on instances whose voters are mostly gone
+	for id, accepted := range promises {
+		if accepted.Commited {
+			px.learn(id, accepted.V_a)
 		}
-		time.Sleep(10 * time.Millisecond)
 	}
+	if !prepares.reached() {
+		return v_a, false, nextProposal, holder
+	}
+	if px.rangeN.Greater(proposalNumber) {
+		// someone else prepared while we were collecting promises
+		return v_a, false, maxBallot(nextProposal, px.rangeN), ""
+	}
+	px.leading = true
+	px.leaderPid = proposalNumber
+	px.leaderFrom = opID
+	px.leaderValues = promises
+	if px.lease > 0 && !px.closed {
+		px.spawn(func() { px.holdLease(proposalNumber) })
+	}
+	if accepted, found := promises[opID]; found {
+		return accepted.V_a, true, nextProposal, ""
+	}
+	return v_a, true, nextProposal, ""
+}
+
+// leaderProposal reports whether Phase 1 can be skipped for opID, and if so
+// the proposal number and the value that must be proposed.
+func (px *paxos) leaderProposal(opID int, v_a []byte) (Ballot, []byte, bool) {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+
+	if !px.leading || opID < px.leaderFrom {
+		return NilBallot, v_a, false
+	}
+	if px.membershipOf(opID) != px.membershipOf(px.leaderFrom) {
+		// the promises came from the old voters, a new set has to be prepared
+		return NilBallot, v_a, false
+	}
+	if accepted, found := px.leaderValues[opID]; found {
+		return px.leaderPid, accepted.V_a, true
+	}
+	return px.leaderPid, v_a, true
+}
 
+func (px *paxos) stepDown(proposalNumber Ballot) {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	if px.leaderPid == proposalNumber {
+		px.leading = false
+		px.leaseUntil = time.Time{}
+	}
+}
+
+func (px *paxos) highestPromise() Ballot {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	return px.rangeN
+}
+
+func (px *paxos) isClosed() bool {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	return px.closed
+}
+
+func (px *paxos) doneOf(node int) int {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	return px.maxNodeDone[node]
 }
 
 func (px *paxos) Prepare(args *PaxosAgrs, reply *PaxosReply) error {
@@ -185,36 +505,106 @@ func (px *paxos) Prepare(args *PaxosAgrs, reply *PaxosReply) error {
 	px.clearLog()
 
 	reply.OK = false
-	operation := px.findOperation(args.Rid)
-	if operation.n_h < args.Pid {
-		operation.n_h = args.Pid
+	if holder, held := px.leaseHeld(args.Self); held {
+		reply.LeaseHolder = holder
+		px.traceReject(EventPrepare, args.Rid, args.Pid, px.peer(args.Self), px.rangeN)
+		return nil
+	}
+	if !args.Multi {
+		operation := px.findOperation(args.Rid)
+		if operation.n_h.Less(args.Pid) {
+			operation.n_h = args.Pid
+
+			px.ops[args.Rid] = operation
+			if err := px.persist(args.Rid, operation); err != nil {
+				return err
+			}
+			reply.N_a = operation.n_a
+			reply.V_a = operation.v_a
+			reply.OK = true
+			px.noteRival(args)
+			px.trace(EventPromise, args.Rid, args.Pid, px.peer(args.Self))
+		} else {
+			reply.N_h = operation.n_h
+			px.traceReject(EventPrepare, args.Rid, args.Pid, px.peer(args.Self), operation.n_h)
+		}
+		return nil
+	}
 
-		px.ops[args.Rid] = operation
-		reply.N_a = operation.n_a
-		reply.V_a = operation.v_a
-		reply.OK = true
-	} else {
-		reply.N_h = operation.n_h
+	// a range prepare must beat every promise made for instances >= Rid
+	highest := px.rangeN
+	for opID, operation := range px.ops {
+		if opID >= args.Rid {
+			highest = maxBallot(highest, operation.n_h)
+		}
+	}
+	if !highest.Less(args.Pid) {
+		reply.N_h = highest
+		px.traceReject(EventPrepare, args.Rid, args.Pid, px.peer(args.Self), highest)
+		return nil
+	}
+	if args.Self != px.self && args.Pid.Greater(px.leaderPid) {
+		px.leading = false
+		px.leaseUntil = time.Time{}
 	}
+	if args.Self != px.grantHolder {
+		// any grant has run out, or this Prepare would have been refused
+		px.grantHolder = -1
+	}
+	reply.Accepted = make(map[int]Proposal)
+	for opID, operation := range px.ops {
+		if opID < args.Rid {
+			continue
+		}
+		operation.n_h = args.Pid
+		px.ops[opID] = operation
+		if operation.commited || operation.n_a != NilBallot {
+			reply.Accepted[opID] = Proposal{operation.n_a, operation.v_a, operation.commited}
+		}
+	}
+	// promising more than asked for is always safe
+	if px.rangeFrom < 0 || args.Rid < px.rangeFrom {
+		px.rangeFrom = args.Rid
+	}
+	px.rangeN = args.Pid
+	if px.store != nil {
+		defer sim.Busy(px.clock)()
+		px.appended++
+		if err := px.store.Append(Record{Range: true, RangeFrom: px.rangeFrom, RangeN: px.rangeN}); err != nil {
+			return err
+		}
+	}
+	px.noteRival(args)
+	px.trace(EventPromise, args.Rid, args.Pid, px.peer(args.Self))
+	reply.OK = true
 	return nil
 }
 
 func (px *paxos) Accept(args *PaxosAgrs, reply *PaxosReply) error {
 	px.phaseLock.Lock()
 	defer px.phaseLock.Unlock()
+	px.maxNodeDone[args.Self] = max(px.maxNodeDone[args.Self], args.CommitFinished)
+	px.clearLog()
 
 	reply.OK = false
 	operation := px.findOperation(args.Rid)
-	if operation.n_h <= args.Pid {
+	// a decided value is final; a stale leader learns it through Prepare
+	if !operation.commited && !operation.n_h.Greater(args.Pid) {
 		operation.n_h = args.Pid
 		operation.n_a = args.Pid
 
 		operation.v_a = args.V_a
-		reply.Pid = args.Pid
 		px.ops[args.Rid] = operation
+		if err := px.persist(args.Rid, operation); err != nil {
+			return err
+		}
+		reply.Pid = args.Pid
 		reply.OK = true
+		px.noteRival(args)
+		px.trace(EventAccepted, args.Rid, args.Pid, px.peer(args.Self))
 	} else {
 		reply.N_h = operation.n_h
+		px.traceReject(EventAccept, args.Rid, args.Pid, px.peer(args.Self), operation.n_h)
 	}
 	return nil
 }
@@ -222,14 +612,77 @@ func (px *paxos) Accept(args *PaxosAgrs, reply *PaxosReply) error {
 func (px *paxos) Commit(args *PaxosAgrs, reply *PaxosReply) error {
 	px.phaseLock.Lock()
 	defer px.phaseLock.Unlock()
-	operation := px.findOperation(args.Rid)
-	operation.v_a = args.V_a
-	operation.commited = true
-	px.ops[args.Rid] = operation
+	px.maxNodeDone[args.Self] = max(px.maxNodeDone[args.Self], args.CommitFinished)
+	px.trace(EventCommit, args.Rid, args.Pid, px.peer(args.Self))
+	if err := px.learn(args.Rid, args.V_a); err != nil {
+		return err
+	}
 	reply.OK = true
 	return nil
 }
 
+// learn records a decided value; the caller holds phaseLock.
+func (px *paxos) learn(opID int, v_a []byte) error {
+	operation := px.findOperation(opID)
+	if operation.commited {
+		return nil
+	}
+	operation.v_a = v_a
+	operation.commited = true
+	px.ops[opID] = operation
+	delete(px.leaderValues, opID)
+	close(px.changed)
+	px.changed = make(chan struct{})
+	return px.persist(opID, operation)
+}
+
+// Subscribe returns a channel that delivers every instance >= from once it
+// is decided here, each exactly once and in instance order, so an instance
+// that is still open holds back the ones after it. The channel is closed
+// by Close. Subscribe may be called once.
+func (px *paxos) Subscribe(from int) <-chan Decision {
+	decisions := make(chan Decision)
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	if px.closed {
+		close(decisions)
+	} else {
+		px.spawn(func() { px.deliver(from, decisions) })
+	}
+	return decisions
+}
+
+func (px *paxos) deliver(next int, decisions chan Decision) {
+	defer close(decisions)
+	for {
+		px.phaseLock.Lock()
+		changed := px.changed
+		ready := []Decision{}
+		for {
+			operation, found := px.ops[next]
+			if !found || !operation.commited {
+				break
+			}
+			ready = append(ready, Decision{next, operation.v_a})
+			next++
+		}
+		px.phaseLock.Unlock()
+
+		for _, decision := range ready {
+			select {
+			case decisions <- decision:
+			case <-px.ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-changed:
+		case <-px.ctx.Done():
+			return
+		}
+	}
+}
+
 func (px *paxos) CommitFinished(opID int) {
 	px.phaseLock.Lock()
 	defer px.phaseLock.Unlock()
@@ -238,6 +691,8 @@ func (px *paxos) CommitFinished(opID int) {
 }
 
 func (px *paxos) MaxID() int {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
 	maxOperationID := -1
 	for opID := range px.ops {
 		maxOperationID = max(maxOperationID, opID)
@@ -245,56 +700,249 @@ func (px *paxos) MaxID() int {
 	return maxOperationID
 }
 
+// MinID is the lowest instance this node still keeps; everything below it
+// has been applied by every member and is Forgotten.
 func (px *paxos) MinID() int {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	return px.minID()
+}
+
+// Status reports the fate of one instance, and its value once Decided.
+func (px *paxos) Status(opID int) (Fate, []byte) {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	if opID < px.minID() {
+		return Forgotten, nil
+	}
+	if operation, found := px.ops[opID]; found && operation.commited {
+		return Decided, operation.v_a
+	}
+	return Pending, nil
+}
+
+// Watermarks returns, by address, the highest instance each member (and
+// this node) has reported through CommitFinished; -1 means none yet.
+func (px *paxos) Watermarks() map[string]int {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	watermarks := map[string]int{px.nodes[px.self]: px.maxNodeDone[px.self]}
+	for _, id := range px.appliers() {
+		watermarks[px.nodes[id]] = px.maxNodeDone[id]
+	}
+	return watermarks
+}
+
+// minID is MinID for callers that hold phaseLock.
+func (px *paxos) minID() int {
 	self := px.self
 	minOperationID := px.maxNodeDone[self]
-	for _, opDone := range px.maxNodeDone {
-		minOperationID = min(minOperationID, opDone)
+	// nodes that left have stopped applying and no longer count
+	for _, id := range px.appliers() {
+		minOperationID = min(minOperationID, px.maxNodeDone[id])
 	}
 	return minOperationID + 1
 }
 
 func (px *paxos) Close() {
+	px.phaseLock.Lock()
 	px.closed = true
+	px.cancel()
+	for conn := range px.conns {
+		conn.Close()
+	}
+	px.phaseLock.Unlock()
 	if px.listen != nil {
 		px.listen.Close()
 	}
+	// proposers may still be writing decisions to the store
+	px.running.Wait()
+	if px.store != nil {
+		px.store.Close()
+	}
+	if px.ownTransport {
+		px.transport.Close()
+	}
 }
 
 // utility methods
-func (px *paxos) rpcCall(address string, serviceMethod string, args interface{}, reply interface{}) bool {
-	var err error
-	if px.isDebug && rand.Int()%2 == 0 {
-		return false
+
+// response is one peer's answer to a broadcast; ok is false if the
+// call failed or timed out.
+type response struct {
+	node  int
+	reply *PaxosReply
+	ok    bool
+}
+
+// broadcast sends args to every one of ids at once. The channel is buffered
+// for all of them, so replies nobody waits for anymore are dropped safely.
+func (px *paxos) broadcast(serviceMethod string, args *PaxosAgrs, ids []int) chan response {
+	responses := make(chan response, len(ids))
+	for _, i := range ids {
+		i, node := i, px.address(i)
+		px.spawn(func() {
+			reply := &PaxosReply{}
+			ok := false
+			if i == px.self {
+				ok = px.localCall(serviceMethod, args, reply) == nil
+			} else {
+				ok = px.rpcCall(node, serviceMethod, args, reply)
+			}
+			responses <- response{i, reply, ok}
+		})
 	}
+	return responses
+}
 
-	c, err := rpc.Dial("tcp", address)
-	if err != nil {
+func (px *paxos) addresses(ids []int) []string {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	addresses := []string{}
+	for _, id := range ids {
+		addresses = append(addresses, px.nodes[id])
+	}
+	return addresses
+}
+
+func (px *paxos) address(id int) string {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	return px.nodes[id]
+}
+
+func (px *paxos) localCall(serviceMethod string, args *PaxosAgrs, reply *PaxosReply) error {
+	switch serviceMethod {
+	case "Paxos.Prepare":
+		return px.Prepare(args, reply)
+	case "Paxos.Accept":
+		return px.Accept(args, reply)
+	case "Paxos.Lease":
+		return px.Lease(args, reply)
+	default:
+		return px.Commit(args, reply)
+	}
+}
+
+func (px *paxos) rpcCall(address string, serviceMethod string, args interface{}, reply interface{}) bool {
+	atomic.AddInt32(&px.rpcCount, 1)
+	if px.isDebug && px.drop() {
+		px.counters.rpc(address, serviceMethod, false)
 		return false
 	}
-	defer c.Close()
-	err = c.Call(serviceMethod, args, reply)
-	if err == nil {
-		return true
-	} 
-	return false
+	// the reply is only read after done, so a call that times out
+	// can still fill it in without anyone looking; cancel ends it
+	ctx, cancel := context.WithCancel(px.ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	px.spawn(func() {
+		done <- px.transport.CallContext(ctx, address, serviceMethod, args, reply)
+	})
+	ok := false
+	select {
+	case err := <-done:
+		ok = err == nil
+	case <-px.clock.After(px.rpcTimeout):
+	case <-px.ctx.Done():
+	}
+	px.counters.rpc(address, serviceMethod, ok)
+	return ok
+}
+
+// drop decides whether a debug node loses an RPC.
+func (px *paxos) drop() bool {
+	px.randLock.Lock()
+	defer px.randLock.Unlock()
+	return px.random.Intn(2) == 0
 }
 
 func (px *paxos) findOperation(opID int) Operation {
 	if operation, found := px.ops[opID]; found {
 		return operation
 	} else {
-		px.ops[opID] = CreateOperation()
-		operation := px.ops[opID]
+		operation := CreateOperation()
+		// a range promise also covers instances we have not heard of yet
+		if px.rangeFrom >= 0 && opID >= px.rangeFrom {
+			operation.n_h = px.rangeN
+		}
+		px.ops[opID] = operation
 		return operation
 	}
 }
 
 func (px *paxos) clearLog() {
-	min := px.MinID()
+	min := px.minID()
 	for opID := range px.ops {
 		if opID < min {
 			delete(px.ops, opID)
+			px.counters.add(&px.counters.stats.InstancesCollected, 1)
+		}
+	}
+	for opID := range px.leaderValues {
+		if opID < min {
+			delete(px.leaderValues, opID)
+		}
+	}
+	if px.store != nil && px.appended > compactThreshold+len(px.ops) {
+		defer sim.Busy(px.clock)()
+		if px.store.Rewrite(px.records()) == nil {
+			px.appended = 0
+		}
+	}
+}
+
+// persist writes the state of one instance ahead of any reply that depends on it.
+func (px *paxos) persist(opID int, operation Operation) error {
+	if px.store == nil {
+		return nil
+	}
+	defer sim.Busy(px.clock)()
+	px.appended++
+	return px.store.Append(Record{
+		Rid:      opID,
+		N_a:      operation.n_a,
+		N_h:      operation.n_h,
+		Commited: operation.commited,
+		V_a:      operation.v_a,
+	})
+}
+
+func (px *paxos) records() []Record {
+	records := []Record{}
+	if px.rangeFrom >= 0 {
+		records = append(records, Record{Range: true, RangeFrom: px.rangeFrom, RangeN: px.rangeN})
+	}
+	for opID, operation := range px.ops {
+		records = append(records, Record{
+			Rid:      opID,
+			N_a:      operation.n_a,
+			N_h:      operation.n_h,
+			Commited: operation.commited,
+			V_a:      operation.v_a,
+		})
+	}
+	return records
+}
+
+// replay rebuilds acceptor state from the store, oldest record first.
+func (px *paxos) replay(records []Record) {
+	for _, record := range records {
+		if record.Range {
+			px.rangeFrom = record.RangeFrom
+			px.rangeN = record.RangeN
+			for opID, operation := range px.ops {
+				if opID >= record.RangeFrom && operation.n_h.Less(record.RangeN) {
+					operation.n_h = record.RangeN
+					px.ops[opID] = operation
+				}
+			}
+			continue
+		}
+		px.ops[record.Rid] = Operation{
+			n_a:      record.N_a,
+			n_h:      record.N_h,
+			commited: record.Commited,
+			v_a:      record.V_a,
 		}
 	}
 }
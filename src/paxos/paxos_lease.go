@@ -0,0 +1,163 @@
+package paxos
+
+import "context"
+import "time"
+
+// bound on how far the clock rates of two nodes differ unless Config.Drift says otherwise
+const DefaultDrift = 0.01
+
+// Lease grants the caller a lease if this node still promises its ballot
+// and nobody else holds one. For Config.Lease from now on this node
+// refuses every Prepare but the holder's.
+func (px *paxos) Lease(args *PaxosAgrs, reply *PaxosReply) error {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	now := px.clock.Now()
+	if px.lease <= 0 || args.Pid != px.rangeN || (args.Self != px.grantHolder && now.Before(px.grantUntil)) {
+		reply.N_h = px.rangeN
+		return nil
+	}
+	px.grantHolder = args.Self
+	px.grantUntil = now.Add(px.lease)
+	reply.OK = true
+	return nil
+}
+
+// Forward asks this node, which holds a lease, to propose a value another
+// node could not. If the instance is decided already, the caller gets the
+// decision instead; nobody may have told it.
+func (px *paxos) Forward(args *PaxosAgrs, reply *PaxosReply) error {
+	if decided, v_a := px.GetLog(args.Rid); decided {
+		commit := &PaxosAgrs{args.Rid, NilBallot, px.doneOf(px.self), px.self, v_a, false}
+		px.phaseLock.Lock()
+		if !px.closed {
+			px.spawn(func() { px.sendCommit(args.Self, commit) })
+		}
+		px.phaseLock.Unlock()
+	} else {
+		px.StartPaxos(args.Rid, args.V_a)
+	}
+	reply.OK = true
+	return nil
+}
+
+// leaseHeld tells whether a lease keeps node from preparing, and who holds
+// it; "" while nobody may. The caller holds phaseLock.
+func (px *paxos) leaseHeld(node int) (string, bool) {
+	if px.lease <= 0 || node == px.grantHolder || !px.clock.Now().Before(px.grantUntil) {
+		return "", false
+	}
+	if px.grantHolder < 0 {
+		return "", true
+	}
+	return px.nodes[px.grantHolder], true
+}
+
+// holdLease keeps renewing the lease of ballot pid for as long as this
+// node leads with it.
+func (px *paxos) holdLease(pid Ballot) {
+	for {
+		px.phaseLock.Lock()
+		if px.closed || !px.leading || px.leaderPid != pid {
+			px.phaseLock.Unlock()
+			return
+		}
+		memberships := append([]Membership{}, px.memberships[px.membershipOf(px.leaderFrom):]...)
+		px.phaseLock.Unlock()
+
+		// acceptors count their grant from when they get the request, so
+		// it outlasts ours, measured from before sending, whatever the drift
+		start := px.clock.Now()
+		if px.renewLease(pid, memberships) {
+			px.phaseLock.Lock()
+			if px.leading && px.leaderPid == pid {
+				px.leasePid = pid
+				px.leaseUntil = start.Add(time.Duration(float64(px.lease) * (1 - px.drift)))
+			}
+			px.phaseLock.Unlock()
+		}
+		if !px.sleep(px.ctx, px.lease/4) {
+			return
+		}
+	}
+}
+
+// renewLease asks for grants and reports whether a Phase 2 quorum of every
+// membership the leader proposes in granted them; every Prepare quorum of
+// those meets one of the grantors.
+func (px *paxos) renewLease(pid Ballot, memberships []Membership) bool {
+	ids := []int{}
+	tallies := []*tally{}
+	for _, m := range memberships {
+		tallies = append(tallies, newTally(px.quorum, 2, px.addresses(m.Members)))
+		for _, id := range m.Members {
+			if !contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	responses := px.broadcast("Paxos.Lease", &PaxosAgrs{Pid: pid, CommitFinished: px.doneOf(px.self), Self: px.self}, ids)
+	for range ids {
+		response := <-responses
+		address := px.address(response.node)
+		for i, m := range memberships {
+			if contains(m.Members, response.node) {
+				tallies[i].record(address, response.ok && response.reply.OK)
+			}
+		}
+	}
+	for _, t := range tallies {
+		if !t.reached() {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadIndex reports whether this node holds a leader lease right now. If
+// it does, no instance above the returned one can have been decided
+// anywhere, so once everything up to it is applied here, a read from the
+// local copy sees every write that finished before ReadIndex was called.
+func (px *paxos) ReadIndex() (int, bool) {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	if px.lease <= 0 || !px.leading || px.leasePid != px.leaderPid || !px.clock.Now().Before(px.leaseUntil) {
+		return -1, false
+	}
+	// an instance below leaderFrom is covered by waiting for leaderFrom-1;
+	// one above was either reported by our Prepare or decided by us
+	index := px.leaderFrom - 1
+	for opID, operation := range px.ops {
+		if operation.commited || operation.n_a != NilBallot {
+			index = max(index, opID)
+		}
+	}
+	for opID := range px.leaderValues {
+		index = max(index, opID)
+	}
+	return index, true
+}
+
+// forward hands v_a to the lease holder and waits a lease period for the
+// instance to be decided before the caller tries again.
+func (px *paxos) forward(ctx context.Context, holder string, opID int, v_a []byte) {
+	px.rpcCall(holder, "Paxos.Forward", &PaxosAgrs{Rid: opID, Self: px.self, CommitFinished: px.doneOf(px.self), V_a: v_a}, &PaxosReply{})
+	timeout := px.clock.After(px.lease)
+	for {
+		px.phaseLock.Lock()
+		changed := px.changed
+		px.phaseLock.Unlock()
+		if decided, _ := px.GetLog(opID); decided {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return
+		case <-ctx.Done():
+			return
+		case <-px.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package paxos
+
+import "sort"
+
+// Membership is the set of voting nodes for every instance >= From, up to
+// the From of the next one. Members are indexes into paxos.nodes, which
+// only ever grows, so a node keeps its index (and its ballots) for good.
+type Membership struct {
+	From    int
+	Members []int
+}
+
+// Reconfigure makes members the voting nodes for every instance >= from.
+// Every node has to call it with the same arguments, in the same order,
+// and before any instance >= from is started; the server makes sure of
+// that by applying the change alpha instances ahead of where it is used.
+// Calling it again with an earlier from replaces the later memberships,
+// so replaying the same changes after a restart is harmless. Members the
+// quorum system cannot work with are rejected and nothing changes.
+func (px *paxos) Reconfigure(from int, members []string) error {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	if err := px.quorum.Validate(members); err != nil {
+		return err
+	}
+
+	current := px.memberships[len(px.memberships)-1]
+	ids := []int{}
+	for _, address := range members {
+		id := px.nodeID(address)
+		if id < 0 {
+			px.nodes = append(px.nodes, address)
+			id = len(px.nodes) - 1
+		}
+		if !contains(current.Members, id) {
+			// a joining node has not applied anything yet: keep every
+			// instance we still hold until it reports its own progress
+			px.maxNodeDone[id] = px.maxNodeDone[px.self]
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for len(px.memberships) > 0 && px.memberships[len(px.memberships)-1].From >= from {
+		px.memberships = px.memberships[:len(px.memberships)-1]
+	}
+	px.memberships = append(px.memberships, Membership{from, ids})
+	return nil
+}
+
+// membershipOf returns the index of the membership instance opID is decided
+// under; the caller holds phaseLock.
+func (px *paxos) membershipOf(opID int) int {
+	i := len(px.memberships) - 1
+	for i > 0 && px.memberships[i].From > opID {
+		i--
+	}
+	return i
+}
+
+// voters returns the nodes whose majority decides opID.
+func (px *paxos) voters(opID int) []int {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	return px.memberships[px.membershipOf(opID)].Members
+}
+
+// learners returns the nodes a decision for opID is sent to: its voters,
+// and anyone who joined since or only learns and has to catch up on it.
+func (px *paxos) learners(opID int) []int {
+	px.phaseLock.Lock()
+	defer px.phaseLock.Unlock()
+	learners := append([]int{}, px.memberships[px.membershipOf(opID)].Members...)
+	for _, id := range px.appliers() {
+		if !contains(learners, id) {
+			learners = append(learners, id)
+		}
+	}
+	return learners
+}
+
+// appliers are the nodes that apply the log from here on: the members of
+// every membership not yet applied to its end by all of them, and the
+// non-voting learners. A removed node votes until the membership without
+// it starts, so it counts until it has applied that far. The caller holds
+// phaseLock.
+func (px *paxos) appliers() []int {
+	appliers := []int{}
+	for i, m := range px.memberships {
+		if i+1 < len(px.memberships) && px.appliedAll(m.Members, px.memberships[i+1].From-1) {
+			continue
+		}
+		for _, id := range m.Members {
+			if !contains(appliers, id) {
+				appliers = append(appliers, id)
+			}
+		}
+	}
+	for _, id := range px.nonVoting {
+		if !contains(appliers, id) {
+			appliers = append(appliers, id)
+		}
+	}
+	return appliers
+}
+
+// appliedAll tells whether every one of ids reported opID done; the
+// caller holds phaseLock.
+func (px *paxos) appliedAll(ids []int, opID int) bool {
+	for _, id := range ids {
+		if px.maxNodeDone[id] < opID {
+			return false
+		}
+	}
+	return true
+}
+
+func (px *paxos) nodeID(address string) int {
+	for i, node := range px.nodes {
+		if node == address {
+			return i
+		}
+	}
+	return -1
+}
+
+func contains(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
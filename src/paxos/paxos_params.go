@@ -1,34 +1,91 @@
 package paxos
 
+import "sim"
+import "time"
+import "transport"
+
 type Operation struct {
-	n_a      int //highest Accepted
-	n_h      int //hightest Proposal Number
+	n_a      Ballot //highest Accepted
+	n_h      Ballot //hightest Proposal Number
 	commited bool
-	v_a      interface{} // each operation value
+	v_a      []byte // each operation value
 }
 
 func CreateOperation() Operation {
 	operation := &Operation{
-		n_a:      -1, //highest Accepted
-		n_h:      -1, //hightest Proposal Number
+		n_a:      NilBallot, //highest Accepted
+		n_h:      NilBallot, //hightest Proposal Number
 		commited: false,
 		v_a:      nil, // each operation value
 	}
 	return *operation
 }
 
+// Config holds the optional settings of a paxos node.
+type Config struct {
+	IsDebug    bool                // drop half of the RPCs, drawn from Seed
+	Seed       int64               // seeds IsDebug, 0 means a fresh seed
+	Clock      sim.Clock           // nil means sim.Wall
+	Store      Store               // nil keeps acceptor state in memory only
+	Transport  transport.Transport // nil picks one from the address of this node
+	Window     int                 // instances proposed concurrently, 0 means DefaultWindow
+	RPCTimeout time.Duration       // deadline of one RPC, 0 means DefaultRPCTimeout
+	Quorum     QuorumSystem        // nil means Majority
+	Learners   []string            // nodes that learn every decision but do not vote
+	Lease      time.Duration       // how long a leader may answer reads alone, 0 means no leases
+	Drift      float64             // bound on how far clock rates differ, 0 means DefaultDrift
+	Backoff    time.Duration       // wait after a failed round, doubled on every further one; 0 means DefaultBackoff
+	MaxBackoff time.Duration       // cap on that wait, 0 means DefaultMaxBackoff
+	Tracer     Tracer              // gets every protocol event, nil means none are recorded
+}
+
+// Fate is what a node knows about one instance.
+type Fate int
+
+const (
+	Decided   Fate = iota + 1
+	Pending        // not decided here yet, or never started
+	Forgotten      // below MinID, its value is gone
+)
+
+// Decision is a decided instance, as delivered by Subscribe.
+type Decision struct {
+	Rid int
+	V_a []byte
+}
+
 type PaxosAgrs struct {
-	Rid            int // operation id
-	Pid            int // proposal number
+	Rid            int    // operation id
+	Pid            Ballot // proposal number
 	CommitFinished int
 	Self           int // record self
-	V_a            interface{}
+	V_a            []byte
+	Multi          bool // Prepare covers every instance >= Rid
 }
 
 type PaxosReply struct {
-	N_a int //highest Accepted
-	N_h int //hightest Proposal Number
+	N_a Ballot //highest Accepted
+	N_h Ballot //hightest Proposal Number
 	OK  bool
-	Pid int         // Proposal number
-	V_a interface{} // each operation value
+	Pid Ballot // Proposal number
+	V_a []byte // each operation value
+
+	Accepted map[int]Proposal // range Prepare: accepted values for instances >= Rid
+
+	LeaseHolder string // Prepare refused because this node holds a lease
+}
+
+// Proposal is what an acceptor reports about one instance in a range Prepare.
+type Proposal struct {
+	N_a      Ballot
+	V_a      []byte
+	Commited bool
+}
+
+type FetchArgs struct {
+	From int // first instance asked for
+}
+
+type FetchReply struct {
+	Decided map[int][]byte // decided values for instances >= From, at most fetchLimit of them
 }
@@ -0,0 +1,214 @@
+package paxos
+
+import "errors"
+import "fmt"
+
+// QuorumSystem decides which sets of nodes may complete a phase. Every
+// Phase 1 quorum has to intersect every Phase 2 quorum; Validate rejects
+// systems where that does not hold for the given members. Nodes are named
+// by address.
+type QuorumSystem interface {
+	IsQuorum(phase int, members []string, agreed []string) bool
+	Validate(members []string) error
+}
+
+// Majority is classic Paxos: more than half of the members, in both phases.
+type Majority struct{}
+
+func (Majority) IsQuorum(phase int, members []string, agreed []string) bool {
+	return len(agreed) > len(members)/2
+}
+
+func (Majority) Validate(members []string) error {
+	if len(members) == 0 {
+		return errors.New("no members")
+	}
+	return nil
+}
+
+// Flexible is Flexible Paxos: any Phase1 members may prepare and any Phase2
+// members may accept, as long as Phase1+Phase2 exceeds the member count.
+// A small Phase2 makes the common case cheaper at the price of a larger
+// Phase1 when the leader changes.
+type Flexible struct {
+	Phase1 int
+	Phase2 int
+}
+
+func (f Flexible) IsQuorum(phase int, members []string, agreed []string) bool {
+	if phase == 1 {
+		return len(agreed) >= f.Phase1
+	}
+	return len(agreed) >= f.Phase2
+}
+
+func (f Flexible) Validate(members []string) error {
+	n := len(members)
+	if f.Phase1 < 1 || f.Phase2 < 1 || f.Phase1 > n || f.Phase2 > n {
+		return fmt.Errorf("quorum sizes %d and %d do not fit %d members", f.Phase1, f.Phase2, n)
+	}
+	if f.Phase1+f.Phase2 <= n {
+		return fmt.Errorf("quorums of %d and %d out of %d members need not overlap", f.Phase1, f.Phase2, n)
+	}
+	return nil
+}
+
+// Weighted counts votes by weight; members not in Weights weigh 1. Phase1
+// and Phase2 are the weights each phase needs, 0 meaning more than half of
+// the total, and together they must exceed the total.
+type Weighted struct {
+	Weights map[string]int
+	Phase1  int
+	Phase2  int
+}
+
+func (w Weighted) weight(nodes []string) int {
+	total := 0
+	for _, node := range nodes {
+		if weight, found := w.Weights[node]; found {
+			total += weight
+		} else {
+			total++
+		}
+	}
+	return total
+}
+
+func (w Weighted) thresholds(members []string) (int, int) {
+	total := w.weight(members)
+	phase1, phase2 := w.Phase1, w.Phase2
+	if phase1 == 0 {
+		phase1 = total/2 + 1
+	}
+	if phase2 == 0 {
+		phase2 = total/2 + 1
+	}
+	return phase1, phase2
+}
+
+func (w Weighted) IsQuorum(phase int, members []string, agreed []string) bool {
+	phase1, phase2 := w.thresholds(members)
+	if phase == 1 {
+		return w.weight(agreed) >= phase1
+	}
+	return w.weight(agreed) >= phase2
+}
+
+func (w Weighted) Validate(members []string) error {
+	for node, weight := range w.Weights {
+		if weight < 0 {
+			return fmt.Errorf("negative weight %d for %s", weight, node)
+		}
+	}
+	total := w.weight(members)
+	phase1, phase2 := w.thresholds(members)
+	if total == 0 {
+		return errors.New("members weigh nothing")
+	}
+	if phase1 > total || phase2 > total {
+		return fmt.Errorf("thresholds %d and %d exceed the total weight %d", phase1, phase2, total)
+	}
+	if phase1+phase2 <= total {
+		return fmt.Errorf("thresholds %d and %d out of %d need not overlap", phase1, phase2, total)
+	}
+	return nil
+}
+
+// Zones builds quorums from a topology, zone name to the addresses in it.
+// A majority inside any one zone is a Phase 2 quorum, so a leader can
+// accept within its own rack; Phase 1 needs a majority inside every zone,
+// which overlaps each of those.
+type Zones map[string][]string
+
+func (z Zones) IsQuorum(phase int, members []string, agreed []string) bool {
+	inZone := 0
+	for _, nodes := range z {
+		zoneMembers := intersect(nodes, members)
+		if len(zoneMembers) == 0 {
+			continue
+		}
+		if len(intersect(zoneMembers, agreed)) > len(zoneMembers)/2 {
+			if phase == 2 {
+				return true
+			}
+			inZone++
+		} else if phase == 1 {
+			return false
+		}
+	}
+	return phase == 1 && inZone > 0
+}
+
+func (z Zones) Validate(members []string) error {
+	zoneOf := make(map[string]string)
+	for zone, nodes := range z {
+		for _, node := range nodes {
+			if other, found := zoneOf[node]; found && other != zone {
+				return fmt.Errorf("%s is in zones %s and %s", node, other, zone)
+			}
+			zoneOf[node] = zone
+		}
+	}
+	if len(members) == 0 {
+		return errors.New("no members")
+	}
+	for _, member := range members {
+		if _, found := zoneOf[member]; !found {
+			return fmt.Errorf("%s is in no zone", member)
+		}
+	}
+	return nil
+}
+
+func intersect(a []string, b []string) []string {
+	both := []string{}
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				both = append(both, x)
+				break
+			}
+		}
+	}
+	return both
+}
+
+// tally collects the answers to one phase until a quorum agreed, or
+// until the ones still outstanding cannot make one anymore.
+type tally struct {
+	quorum  QuorumSystem
+	phase   int
+	members []string
+	agreed  []string
+	waiting map[string]bool
+}
+
+func newTally(quorum QuorumSystem, phase int, members []string) *tally {
+	t := &tally{quorum: quorum, phase: phase, members: members, waiting: make(map[string]bool)}
+	for _, member := range members {
+		t.waiting[member] = true
+	}
+	return t
+}
+
+func (t *tally) record(member string, ok bool) {
+	delete(t.waiting, member)
+	if ok {
+		t.agreed = append(t.agreed, member)
+	}
+}
+
+func (t *tally) reached() bool {
+	return t.quorum.IsQuorum(t.phase, t.members, t.agreed)
+}
+
+func (t *tally) open() bool {
+	if t.reached() {
+		return false
+	}
+	possible := append([]string{}, t.agreed...)
+	for member := range t.waiting {
+		possible = append(possible, member)
+	}
+	return t.quorum.IsQuorum(t.phase, t.members, possible)
+}
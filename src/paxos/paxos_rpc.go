@@ -4,6 +4,9 @@ type RemotePaxosServer interface {
 	Prepare(*PaxosAgrs, *PaxosReply) error
 	Accept(*PaxosAgrs, *PaxosReply) error
 	Commit(*PaxosAgrs, *PaxosReply) error
+	Fetch(*FetchArgs, *FetchReply) error
+	Lease(*PaxosAgrs, *PaxosReply) error
+	Forward(*PaxosAgrs, *PaxosReply) error
 }
 
 type PaxosRPC struct {
@@ -0,0 +1,112 @@
+package paxos
+
+import "strings"
+import "sync"
+import "time"
+
+// Histogram counts observations into buckets. Counts has one more entry
+// than Bounds: the observations above the last bound.
+type Histogram struct {
+	Bounds []float64 // upper bound of each bucket, ascending
+	Counts []int64   // observations per bucket, not cumulative
+	Sum    float64
+	Count  int64
+}
+
+func newHistogram(bounds ...float64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(v float64) {
+	i := 0
+	for i < len(h.Bounds) && v > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+func (h Histogram) copy() Histogram {
+	h.Counts = append([]int64{}, h.Counts...)
+	return h
+}
+
+// RPCKey names the calls to one peer in one phase, such as "Prepare".
+type RPCKey struct {
+	Peer  string
+	Phase string
+}
+
+type RPCCount struct {
+	Sent   int64
+	Failed int64 // no reply: lost, refused or timed out
+}
+
+// Stats is what a node counted since it started.
+type Stats struct {
+	ProposalsStarted   int64
+	ProposalsDecided   int64 // proposals that ended with the instance decided
+	PrepareRejections  int64 // Prepare replies that refused the ballot
+	AcceptRejections   int64
+	InstancesCollected int64 // instances dropped below MinID
+
+	Rounds  Histogram // Prepare or Accept rounds a decided proposal took
+	Latency Histogram // seconds from the start of a proposal to its decision
+
+	RPCs map[RPCKey]RPCCount
+}
+
+// counters guards Stats while the node runs.
+type counters struct {
+	lock  sync.Mutex
+	stats Stats
+}
+
+func newCounters() *counters {
+	return &counters{stats: Stats{
+		Rounds:  newHistogram(1, 2, 3, 5, 10, 20),
+		Latency: newHistogram(.001, .005, .01, .05, .1, .5, 1, 5),
+		RPCs:    make(map[RPCKey]RPCCount),
+	}}
+}
+
+func (c *counters) add(counter *int64, n int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	*counter += n
+}
+
+func (c *counters) decided(rounds int, elapsed time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stats.ProposalsDecided++
+	c.stats.Rounds.observe(float64(rounds))
+	c.stats.Latency.observe(elapsed.Seconds())
+}
+
+func (c *counters) rpc(peer string, serviceMethod string, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := RPCKey{peer, strings.TrimPrefix(serviceMethod, "Paxos.")}
+	count := c.stats.RPCs[key]
+	count.Sent++
+	if !ok {
+		count.Failed++
+	}
+	c.stats.RPCs[key] = count
+}
+
+// Stats returns a copy of the counters of this node.
+func (px *paxos) Stats() Stats {
+	px.counters.lock.Lock()
+	defer px.counters.lock.Unlock()
+	stats := px.counters.stats
+	stats.Rounds = stats.Rounds.copy()
+	stats.Latency = stats.Latency.copy()
+	stats.RPCs = make(map[RPCKey]RPCCount)
+	for key, count := range px.counters.stats.RPCs {
+		stats.RPCs[key] = count
+	}
+	return stats
+}
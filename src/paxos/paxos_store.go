@@ -0,0 +1,127 @@
+package paxos
+
+import "encoding/gob"
+import "os"
+import "sync"
+
+// Store persists acceptor state. Append must not return before the record
+// is durable, because Prepare and Accept reply right after it.
+type Store interface {
+	Append(record Record) error
+	Load() ([]Record, error)
+	Rewrite(records []Record) error
+	Close() error
+}
+
+// Record is one write-ahead entry. Either the full state of instance Rid,
+// or, when Range is set, a range promise for every instance >= RangeFrom.
+type Record struct {
+	Rid      int
+	N_a      Ballot
+	N_h      Ballot
+	Commited bool
+	V_a      []byte
+
+	Range     bool
+	RangeFrom int
+	RangeN    Ballot
+}
+
+type fileStore struct {
+	lock     sync.Mutex
+	fileName string
+	file     *os.File
+	encoder  *gob.Encoder
+}
+
+// NewFileStore opens (or creates) a write-ahead store at fileName.
+func NewFileStore(fileName string) (Store, error) {
+	fs := &fileStore{fileName: fileName}
+	records, err := fs.Load()
+	if err != nil {
+		return nil, err
+	}
+	// rewrite on open so the file always holds a single gob stream
+	// and a torn record from a crash is dropped
+	if err := fs.Rewrite(records); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileStore) Append(record Record) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.file == nil {
+		return os.ErrClosed
+	}
+	if err := fs.encoder.Encode(&record); err != nil {
+		return err
+	}
+	return fs.file.Sync()
+}
+
+func (fs *fileStore) Load() ([]Record, error) {
+	f, err := os.Open(fs.fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []Record{}
+	decoder := gob.NewDecoder(f)
+	for {
+		var record Record
+		if err := decoder.Decode(&record); err != nil {
+			// io.EOF, or a torn write at the tail; everything before it is intact
+			break
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (fs *fileStore) Rewrite(records []Record) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	tmpName := fs.fileName + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	encoder := gob.NewEncoder(f)
+	for i := range records {
+		if err := encoder.Encode(&records[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmpName, fs.fileName); err != nil {
+		f.Close()
+		return err
+	}
+	if fs.file != nil {
+		fs.file.Close()
+	}
+	fs.file = f
+	fs.encoder = encoder
+	return nil
+}
+
+func (fs *fileStore) Close() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
@@ -7,6 +7,14 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "sync/atomic"
+import "net"
+import "bytes"
+import "sync"
+import "encoding/json"
+import "context"
+import "strings"
+import "transport"
 
 func port(tag string, host int) string {
 	s := "/var/tmp/824-"
@@ -21,14 +29,19 @@ func port(tag string, host int) string {
 
 var passed = 0
 
+// value is how the tests turn whatever they propose into bytes.
+func value(v interface{}) []byte {
+	return []byte(fmt.Sprint(v))
+}
+
 func ndecided(t *testing.T, pxa []*paxos, seq int) int {
 	count := 0
-	var v interface{}
+	var v []byte
 	for i := 0; i < len(pxa); i++ {
 		if pxa[i] != nil {
 			decided, v1 := pxa[i].GetLog(seq)
 			if decided {
-				if count > 0 && v != v1 {
+				if count > 0 && !bytes.Equal(v, v1) {
 					t.Fatalf("decided values do not match; seq=%v i=%v v=%v v1=%v",
 						seq, i, v, v1)
 				}
@@ -90,13 +103,13 @@ func noTestSpeed(t *testing.T) {
 		pxh[i] = port("time", i)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = NewPaxos(pxh, i, nil)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
 
 	t0 := time.Now()
 
 	for i := 0; i < 20; i++ {
-		pxa[0].StartPaxos(i, "x")
+		pxa[0].StartPaxos(i, value("x"))
 		waitn(t, pxa, i, npaxos)
 	}
 
@@ -117,12 +130,12 @@ func TestBasic(t *testing.T) {
 	}
 
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = NewPaxos(pxh, i, nil)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
 
 	fmt.Printf("Test: Single proposer ...\n")
 
-	pxa[0].StartPaxos(0, "hello")
+	pxa[0].StartPaxos(0, value("hello"))
 	waitn(t, pxa, 0, npaxos)
 
 	fmt.Printf("  ... Passed\n")
@@ -131,7 +144,7 @@ func TestBasic(t *testing.T) {
 	fmt.Printf("Test: Many proposers, same value ...\n")
 
 	for i := 0; i < npaxos; i++ {
-		pxa[i].StartPaxos(1, 77)
+		pxa[i].StartPaxos(1, value(77))
 	}
 	waitn(t, pxa, 1, npaxos)
 
@@ -140,9 +153,9 @@ func TestBasic(t *testing.T) {
 
 	fmt.Printf("Test: Many proposers, different values ...\n")
 
-	pxa[0].StartPaxos(2, 100)
-	pxa[1].StartPaxos(2, 101)
-	pxa[2].StartPaxos(2, 102)
+	pxa[0].StartPaxos(2, value(100))
+	pxa[1].StartPaxos(2, value(101))
+	pxa[2].StartPaxos(2, value(102))
 	waitn(t, pxa, 2, npaxos)
 
 	fmt.Printf("  ... Passed\n")
@@ -150,12 +163,12 @@ func TestBasic(t *testing.T) {
 
 	fmt.Printf("Test: Out-of-order instances ...\n")
 
-	pxa[0].StartPaxos(7, 700)
-	pxa[0].StartPaxos(6, 600)
-	pxa[1].StartPaxos(5, 500)
+	pxa[0].StartPaxos(7, value(700))
+	pxa[0].StartPaxos(6, value(600))
+	pxa[1].StartPaxos(5, value(500))
 	waitn(t, pxa, 7, npaxos)
-	pxa[0].StartPaxos(4, 400)
-	pxa[1].StartPaxos(3, 300)
+	pxa[0].StartPaxos(4, value(400))
+	pxa[1].StartPaxos(3, value(300))
 	waitn(t, pxa, 6, npaxos)
 	waitn(t, pxa, 5, npaxos)
 	waitn(t, pxa, 4, npaxos)
@@ -181,29 +194,29 @@ func TestDeaf(t *testing.T) {
 		pxh[i] = port("deaf", i)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = NewPaxos(pxh, i, nil)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
 
 	fmt.Printf("Test: Deaf proposer ...\n")
 
-	pxa[0].StartPaxos(0, "hello")
+	pxa[0].StartPaxos(0, value("hello"))
 	waitn(t, pxa, 0, npaxos)
 
 	os.Remove(pxh[0])
 	os.Remove(pxh[npaxos-1])
 
-	pxa[1].StartPaxos(1, "goodbye")
+	pxa[1].StartPaxos(1, value("goodbye"))
 	waitmajority(t, pxa, 1)
 	time.Sleep(1 * time.Second)
 	if ndecided(t, pxa, 1) != npaxos-2 {
 		t.Fatalf("a deaf peer heard about a decision")
 	}
 
-	pxa[0].StartPaxos(1, "xxx")
+	pxa[0].StartPaxos(1, value("xxx"))
 	waitn(t, pxa, 1, npaxos-1)
 	time.Sleep(1 * time.Second)
 
-	pxa[npaxos-1].StartPaxos(1, "yyy")
+	pxa[npaxos-1].StartPaxos(1, value("yyy"))
 	waitn(t, pxa, 1, npaxos)
 
 	fmt.Printf("  ... Passed\n")
@@ -222,7 +235,7 @@ func TestForget(t *testing.T) {
 		pxh[i] = port("gc", i)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = NewPaxos(pxh, i, nil)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
 
 	fmt.Printf("Test: Forgetting ...\n")
@@ -235,11 +248,11 @@ func TestForget(t *testing.T) {
 		}
 	}
 
-	pxa[0].StartPaxos(0, "00")
-	pxa[1].StartPaxos(1, "11")
-	pxa[2].StartPaxos(2, "22")
-	pxa[0].StartPaxos(6, "66")
-	pxa[1].StartPaxos(7, "77")
+	pxa[0].StartPaxos(0, value("00"))
+	pxa[1].StartPaxos(1, value("11"))
+	pxa[2].StartPaxos(2, value("22"))
+	pxa[0].StartPaxos(6, value("66"))
+	pxa[1].StartPaxos(7, value("77"))
 
 	waitn(t, pxa, 0, npaxos)
 
@@ -269,7 +282,7 @@ func TestForget(t *testing.T) {
 		pxa[i].CommitFinished(1)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i].StartPaxos(8+i, "xx")
+		pxa[i].StartPaxos(8+i, value("xx"))
 	}
 	allok := false
 	for iters := 0; iters < 12; iters++ {
@@ -305,7 +318,7 @@ func TestManyForget(t *testing.T) {
 		pxh[i] = port("manygc", i)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = NewPaxos(pxh, i, nil)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
 
 	fmt.Printf("Test: Lots of forgetting ...\n")
@@ -319,7 +332,7 @@ func TestManyForget(t *testing.T) {
 			seq := na[i]
 			j := (rand.Int() % npaxos)
 			v := rand.Int()
-			pxa[j].StartPaxos(seq, v)
+			pxa[j].StartPaxos(seq, value(v))
 			runtime.Gosched()
 		}
 	}()
@@ -371,10 +384,10 @@ func TestForgetMem(t *testing.T) {
 		pxh[i] = port("gcmem", i)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = NewPaxos(pxh, i, nil)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
 
-	pxa[0].StartPaxos(0, "x")
+	pxa[0].StartPaxos(0, value("x"))
 	waitn(t, pxa, 0, npaxos)
 
 	runtime.GC()
@@ -387,7 +400,7 @@ func TestForgetMem(t *testing.T) {
 		for j := 0; j < len(big); j++ {
 			big[j] = byte(rand.Int() % 100)
 		}
-		pxa[0].StartPaxos(i, string(big))
+		pxa[0].StartPaxos(i, value(string(big)))
 		waitn(t, pxa, i, npaxos)
 	}
 
@@ -400,7 +413,7 @@ func TestForgetMem(t *testing.T) {
 		pxa[i].CommitFinished(10)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i].StartPaxos(11+i, "z")
+		pxa[i].StartPaxos(11+i, value("z"))
 	}
 	time.Sleep(3 * time.Second)
 	for i := 0; i < npaxos; i++ {
@@ -436,13 +449,13 @@ func TestRPCCount(t *testing.T) {
 		pxh[i] = port("count", i)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = NewPaxos(pxh, i, nil)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
 
 	ninst1 := 5
 	seq := 0
 	for i := 0; i < ninst1; i++ {
-		pxa[0].StartPaxos(seq, "x")
+		pxa[0].StartPaxos(seq, value("x"))
 		waitn(t, pxa, seq, npaxos)
 		seq++
 	}
@@ -450,12 +463,14 @@ func TestRPCCount(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 	total1 := 0
+	for j := 0; j < npaxos; j++ {
+		total1 += int(atomic.LoadInt32(&pxa[j].rpcCount))
+	}
 
-	// per agreement:
-	// 3 prepares
-	// 3 accepts
-	// 3 decides
-	expected1 := ninst1 * npaxos * npaxos
+	// a single proposer prepares once, then per agreement:
+	// 2 accepts
+	// 2 decides
+	expected1 := (npaxos - 1) + ninst1*(npaxos-1)*2
 	if total1 > expected1 {
 		t.Fatalf("too many RPCs for serial Start()s; %v instances, got %v, expected %v",
 			ninst1, total1, expected1)
@@ -464,7 +479,7 @@ func TestRPCCount(t *testing.T) {
 	ninst2 := 5
 	for i := 0; i < ninst2; i++ {
 		for j := 0; j < npaxos; j++ {
-			go pxa[j].StartPaxos(seq, j+(i*10))
+			go pxa[j].StartPaxos(seq, value(j+(i*10)))
 		}
 		waitn(t, pxa, seq, npaxos)
 		seq++
@@ -473,6 +488,10 @@ func TestRPCCount(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 	total2 := 0
+	for j := 0; j < npaxos; j++ {
+		total2 += int(atomic.LoadInt32(&pxa[j].rpcCount))
+	}
+	total2 -= total1
 
 	// per agreement:
 	// 9 prepares
@@ -488,89 +507,284 @@ func TestRPCCount(t *testing.T) {
 	passed++
 }
 
-//
-// many agreements (without failures)
-//
-func TestMany(t *testing.T) {
+func TestStats(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
-	fmt.Printf("Test: Many instances ...\n")
+	fmt.Printf("Test: Stats count proposals, rounds and RPCs ...\n")
 
 	const npaxos = 3
+	const ninst = 5
 	var pxa []*paxos = make([]*paxos, npaxos)
 	var pxh []string = make([]string, npaxos)
 	defer cleanup(pxa)
 
 	for i := 0; i < npaxos; i++ {
-		pxh[i] = port("many", i)
+		pxh[i] = port("stats", i)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = NewPaxos(pxh, i, nil)
-		pxa[i].StartPaxos(0, 0)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
 
-	const ninst = 50
-	for seq := 1; seq < ninst; seq++ {
-		// only 5 active instances, to limit the
-		// number of file descriptors.
-		for seq >= 5 && ndecided(t, pxa, seq-5) < npaxos {
-			time.Sleep(20 * time.Millisecond)
+	for seq := 0; seq < ninst; seq++ {
+		pxa[0].StartPaxos(seq, value("x"))
+		waitn(t, pxa, seq, npaxos)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	stats := pxa[0].Stats()
+	if stats.ProposalsStarted != ninst || stats.ProposalsDecided != ninst {
+		t.Fatalf("started %v and decided %v proposals, expected %v", stats.ProposalsStarted, stats.ProposalsDecided, ninst)
+	}
+	// nobody competes, so every instance takes one round
+	if stats.Rounds.Count != ninst || stats.Rounds.Counts[0] != ninst || stats.Rounds.Sum != ninst {
+		t.Fatalf("rounds %+v, expected %v single rounds", stats.Rounds, ninst)
+	}
+	if stats.Latency.Count != ninst || stats.PrepareRejections != 0 || stats.AcceptRejections != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	sent := int64(0)
+	for key, count := range stats.RPCs {
+		if count.Failed != 0 {
+			t.Fatalf("%v failed RPCs to %v", count.Failed, key)
+		}
+		sent += count.Sent
+	}
+	if sent != int64(atomic.LoadInt32(&pxa[0].rpcCount)) {
+		t.Fatalf("stats count %v RPCs, rpcCount %v", sent, pxa[0].rpcCount)
+	}
+	for i := 1; i < npaxos; i++ {
+		if n := stats.RPCs[RPCKey{pxh[i], "Accept"}].Sent; n != ninst {
+			t.Fatalf("%v Accepts sent to %v, expected %v", n, i, ninst)
+		}
+	}
+
+	// instances everyone is done with are collected
+	for i := 0; i < npaxos; i++ {
+		pxa[i].CommitFinished(ninst - 1)
+	}
+	for iters := 0; pxa[0].Stats().InstancesCollected == 0; iters++ {
+		if iters == 30 {
+			t.Fatalf("no instances collected")
 		}
+		// every node has to tell the others how far it is done
 		for i := 0; i < npaxos; i++ {
-			pxa[i].StartPaxos(seq, (seq*10)+i)
+			pxa[i].StartPaxos(ninst+iters*npaxos+i, value("y"))
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
 
-	for {
-		done := true
-		for seq := 1; seq < ninst; seq++ {
-			if ndecided(t, pxa, seq) < npaxos {
-				done = false
-			}
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+func TestTrace(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Trace records every protocol step ...\n")
+
+	const npaxos = 3
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	var buffer bytes.Buffer
+	tracer := NewJSONTracer(&buffer)
+	var lock sync.Mutex
+	events := []Event{}
+	collect := TraceFunc(func(e Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, e)
+		tracer.Trace(e)
+	})
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("trace", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxosWithConfig(pxh, i, nil, &Config{Tracer: collect})
+	}
+
+	// a contended instance
+	for i := 0; i < npaxos; i++ {
+		go pxa[i].StartPaxos(0, value(i))
+	}
+	waitn(t, pxa, 0, npaxos)
+	// a Prepare that comes too late
+	pxa[0].Prepare(&PaxosAgrs{Rid: 0, Pid: NilBallot, CommitFinished: -1, Self: 1, Multi: true}, &PaxosReply{})
+	time.Sleep(100 * time.Millisecond)
+
+	lock.Lock()
+	traced := append([]Event{}, events...)
+	lock.Unlock()
+	kinds := map[EventKind]bool{}
+	late := false
+	for _, e := range traced {
+		if e.Rid != 0 || e.Node == "" || e.Peer == "" {
+			t.Fatalf("event without instance, node or peer: %+v", e)
 		}
-		if done {
-			break
+		kinds[e.Kind] = true
+		if e.Kind == EventReject && e.Of == EventPrepare && e.Node == pxh[0] && e.Peer == pxh[1] && e.Ballot == NilBallot {
+			late = e.Promised != NilBallot
+		}
+	}
+	for _, kind := range []EventKind{EventPrepare, EventPromise, EventAccept, EventAccepted, EventCommit} {
+		if !kinds[kind] {
+			t.Fatalf("no %v event among %v", kind, len(traced))
+		}
+	}
+	if !late {
+		t.Fatalf("the late Prepare was not traced as rejected")
+	}
+
+	read, err := ReadTrace(&buffer)
+	if err != nil || len(read) != len(traced) {
+		t.Fatalf("read back %v of %v events: %v", len(read), len(traced), err)
+	}
+	for i := range read {
+		e := traced[i]
+		if !read[i].Time.Equal(e.Time) {
+			t.Fatalf("event %v read back at %v, written at %v", i, read[i].Time, e.Time)
+		}
+		read[i].Time = e.Time
+		if read[i] != e {
+			t.Fatalf("event %v read back as %+v, written as %+v", i, read[i], e)
+		}
+	}
+
+	var chrome bytes.Buffer
+	if err := WriteChromeTrace(&chrome, read); err != nil {
+		t.Fatalf("WriteChromeTrace: %v", err)
+	}
+	var parsed struct {
+		TraceEvents []map[string]interface{}
+	}
+	if err := json.Unmarshal(chrome.Bytes(), &parsed); err != nil {
+		t.Fatalf("Chrome trace is not JSON: %v", err)
+	}
+	instants := 0
+	for _, e := range parsed.TraceEvents {
+		if e["ph"] == "i" {
+			instants++
 		}
+	}
+	if instants != len(read) {
+		t.Fatalf("%v events in the Chrome trace, expected %v", instants, len(read))
+	}
+
+	// a tracer that does not keep up does not hold up the protocol
+	lock.Lock()
+	pxa[0].StartPaxos(1, value(1))
+	for iters := 0; iters < 50 && ndecided(t, pxa, 1) < npaxos; iters++ {
 		time.Sleep(100 * time.Millisecond)
 	}
+	decided := ndecided(t, pxa, 1)
+	lock.Unlock()
+	if decided < npaxos {
+		t.Fatalf("%v of %v decided while the tracer was stuck", decided, npaxos)
+	}
 
 	fmt.Printf("  ... Passed\n")
 	passed++
 }
 
-//
-// a peer starts up, with proposal, after others decide.
-// then another peer starts, without a proposal.
-//
-func TestOld(t *testing.T) {
+// leaked fails t if more goroutines than before are still running once
+// the ones winding down had time to finish.
+func leaked(t *testing.T, before int) {
+	for iters := 0; runtime.NumGoroutine() > before; iters++ {
+		if iters == 50 {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%v goroutines left, %v before:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestClose(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
-	fmt.Printf("Test: Minority proposal ignored ...\n")
+	fmt.Printf("Test: Close stops proposers and wakes waiters ...\n")
 
-	const npaxos = 5
+	const npaxos = 3
 	var pxa []*paxos = make([]*paxos, npaxos)
 	var pxh []string = make([]string, npaxos)
 	defer cleanup(pxa)
 
+	before := runtime.NumGoroutine()
 	for i := 0; i < npaxos; i++ {
-		pxh[i] = port("old", i)
+		pxh[i] = port("close", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxos(pxh, i, nil, false)
+	}
+
+	v, err := pxa[0].Decide(context.Background(), 0, value("x"))
+	if err != nil || !bytes.Equal(v, value("x")) {
+		t.Fatalf("Decide: %v %v", v, err)
+	}
+	if v, err := pxa[1].Wait(context.Background(), 0); err != nil || !bytes.Equal(v, value("x")) {
+		t.Fatalf("Wait: %v %v", v, err)
 	}
 
-	pxa[1] = NewPaxos(pxh, 1, nil)
-	pxa[2] = NewPaxos(pxh, 2, nil)
-	pxa[3] = NewPaxos(pxh, 3, nil)
-	pxa[1].StartPaxos(1, 111)
+	// without a majority nothing is decided, and the proposal gives up
+	// with its context
+	pxa[1].Close()
+	pxa[2].Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := pxa[0].Decide(ctx, 1, value("y")); err != context.DeadlineExceeded {
+		t.Fatalf("Decide without a majority: %v", err)
+	}
 
-	waitmajority(t, pxa, 1)
+	// proposers that never finish, and a waiter, are all let go by Close
+	for seq := 2; seq < 10; seq++ {
+		pxa[0].StartPaxos(seq, value(seq))
+	}
+	waited := make(chan error)
+	go func() {
+		_, err := pxa[0].Wait(context.Background(), 2)
+		waited <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	pxa[0].Close()
+	if err := <-waited; err != ErrClosed {
+		t.Fatalf("Wait on a closed node: %v", err)
+	}
+	// every goroutine of a node is done once Close returns
+	buf := make([]byte, 1<<20)
+	if stacks := string(buf[:runtime.Stack(buf, true)]); strings.Contains(stacks, "paxos.(*paxos).") {
+		t.Fatalf("paxos goroutines still running after Close:\n%s", stacks)
+	}
+	if _, err := pxa[0].Decide(context.Background(), 10, value("z")); err != ErrClosed {
+		t.Fatalf("Decide on a closed node: %v", err)
+	}
+	leaked(t, before)
 
-	pxa[0] = NewPaxos(pxh, 0, nil)
-	pxa[0].StartPaxos(1, 222)
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
 
-	waitn(t, pxa, 1, 4)
+//
+// a node named by something other than a path leaves files alone.
+//
+func TestNotAPath(t *testing.T) {
+	fmt.Printf("Test: Addresses that are not paths touch no files ...\n")
 
-	if false {
-		pxa[4] = NewPaxos(pxh, 4, nil)
-		waitn(t, pxa, 1, npaxos)
+	name := "notapath-" + strconv.Itoa(os.Getpid())
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f.Close()
+	defer os.Remove(name)
+
+	network := transport.NewMemNetwork()
+	px := NewPaxosWithConfig([]string{name}, 0, nil, &Config{Transport: network.Transport()})
+	if px == nil {
+		t.Fatalf("NewPaxosWithConfig failed")
+	}
+	px.Close()
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("starting %v removed the file of that name: %v", name, err)
 	}
 
 	fmt.Printf("  ... Passed\n")
@@ -578,12 +792,12 @@ func TestOld(t *testing.T) {
 }
 
 //
-// many agreements, with unreliable RPC
+// many agreements (without failures)
 //
-func TestManyUnreliable(t *testing.T) {
+func TestMany(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
-	fmt.Printf("Test: Many instances, unreliable RPC ...\n")
+	fmt.Printf("Test: Many instances ...\n")
 
 	const npaxos = 3
 	var pxa []*paxos = make([]*paxos, npaxos)
@@ -591,22 +805,22 @@ func TestManyUnreliable(t *testing.T) {
 	defer cleanup(pxa)
 
 	for i := 0; i < npaxos; i++ {
-		pxh[i] = port("manyun", i)
+		pxh[i] = port("many", i)
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = NewPaxos(pxh, i, nil)
-		pxa[i].StartPaxos(0, 0)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
+		pxa[i].StartPaxos(0, value(0))
 	}
 
 	const ninst = 50
 	for seq := 1; seq < ninst; seq++ {
-		// only 3 active instances, to limit the
+		// only 5 active instances, to limit the
 		// number of file descriptors.
-		for seq >= 3 && ndecided(t, pxa, seq-3) < npaxos {
+		for seq >= 5 && ndecided(t, pxa, seq-5) < npaxos {
 			time.Sleep(20 * time.Millisecond)
 		}
 		for i := 0; i < npaxos; i++ {
-			pxa[i].StartPaxos(seq, (seq*10)+i)
+			pxa[i].StartPaxos(seq, value((seq*10)+i))
 		}
 	}
 
@@ -627,100 +841,929 @@ func TestManyUnreliable(t *testing.T) {
 	passed++
 }
 
-func pp(tag string, src int, dst int) string {
-	s := "/var/tmp/824-"
-	s += strconv.Itoa(os.Getuid()) + "/"
-	s += "px-" + tag + "-"
-	s += strconv.Itoa(os.Getpid()) + "-"
-	s += strconv.Itoa(src) + "-"
-	s += strconv.Itoa(dst)
-	return s
-}
+//
+// one node drives many instances at once, bounded by its window.
+//
+func TestPipeline(t *testing.T) {
+	runtime.GOMAXPROCS(4)
 
-func cleanpp(tag string, n int) {
-	for i := 0; i < n; i++ {
-		for j := 0; j < n; j++ {
-			ij := pp(tag, i, j)
-			os.Remove(ij)
-		}
-	}
-}
+	fmt.Printf("Test: Pipelined instances from one proposer ...\n")
 
-func part(t *testing.T, tag string, npaxos int, p1 []int, p2 []int, p3 []int) {
-	cleanpp(tag, npaxos)
+	const npaxos = 3
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
 
-	pa := [][]int{p1, p2, p3}
-	for pi := 0; pi < len(pa); pi++ {
-		p := pa[pi]
-		for i := 0; i < len(p); i++ {
-			for j := 0; j < len(p); j++ {
-				ij := pp(tag, p[i], p[j])
-				pj := port(tag, p[j])
-				err := os.Link(pj, ij)
-				if err != nil {
-					// one reason this link can fail is if the
-					// corresponding paxos peer has prematurely quit and
-					// deleted its socket file (e.g., called px.Close()).
-					t.Fatalf("os.Link(%v, %v): %v\n", pj, ij, err)
-				}
-			}
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("pipeline", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxosWithConfig(pxh, i, nil, &Config{Window: 4})
+	}
+
+	const ninst = 30
+	for seq := 0; seq < ninst; seq++ {
+		pxa[0].StartPaxos(seq, value(seq*10))
+	}
+	for seq := 0; seq < ninst; seq++ {
+		waitn(t, pxa, seq, npaxos)
+		if _, v := pxa[1].GetLog(seq); string(v) != fmt.Sprint(seq*10) {
+			t.Fatalf("wrong value decided; seq=%v v=%v", seq, v)
 		}
 	}
+	if n := len(pxa[0].window); n != 0 {
+		t.Fatalf("window not released; %v slots still held", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
 }
 
-func TestPartition(t *testing.T) {
+//
+// decisions reach a subscriber once each and in instance order, even
+// when the instances are decided the other way round.
+//
+func TestSubscribe(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
-	tag := "partition"
-	const npaxos = 5
+	fmt.Printf("Test: Subscribe delivers decisions in order ...\n")
+
+	const npaxos = 3
 	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
 	defer cleanup(pxa)
-	defer cleanpp(tag, npaxos)
 
 	for i := 0; i < npaxos; i++ {
-		var pxh []string = make([]string, npaxos)
-		for j := 0; j < npaxos; j++ {
-			if j == i {
-				pxh[j] = port(tag, i)
-			} else {
-				pxh[j] = pp(tag, i, j)
-			}
-		}
-		pxa[i] = NewPaxos(pxh, i, nil)
+		pxh[i] = port("subscribe", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
-	defer part(t, tag, npaxos, []int{}, []int{}, []int{})
-
-	seq := 0
 
-	fmt.Printf("Test: No decision if partitioned ...\n")
+	const ninst = 10
+	decisions := pxa[2].Subscribe(3)
+	for seq := ninst - 1; seq >= 0; seq-- {
+		pxa[0].StartPaxos(seq, value(seq*10))
+		waitn(t, pxa, seq, npaxos)
+	}
+	for seq := 3; seq < ninst; seq++ {
+		decision := <-decisions
+		if decision.Rid != seq || string(decision.V_a) != fmt.Sprint(seq*10) {
+			t.Fatalf("expected instance %v = %v, got %+v", seq, seq*10, decision)
+		}
+	}
+	select {
+	case decision := <-decisions:
+		t.Fatalf("unexpected decision %+v", decision)
+	case <-time.After(200 * time.Millisecond):
+	}
 
-	part(t, tag, npaxos, []int{0, 2}, []int{1, 3}, []int{4})
-	pxa[1].StartPaxos(seq, 111)
-	checkmax(t, pxa, seq, 0)
+	pxa[2].Close()
+	if _, ok := <-decisions; ok {
+		t.Fatalf("Close did not close the channel")
+	}
+	pxa[2] = nil
 
 	fmt.Printf("  ... Passed\n")
 	passed++
+}
 
-	fmt.Printf("Test: Decision in majority partition ...\n")
+//
+// Status tells decided, pending and forgotten instances apart, and
+// Watermarks shows why an instance is (not yet) forgotten.
+//
+func TestStatus(t *testing.T) {
+	runtime.GOMAXPROCS(4)
 
-	part(t, tag, npaxos, []int{0}, []int{1, 2, 3}, []int{4})
-	time.Sleep(2 * time.Second)
-	waitmajority(t, pxa, seq)
+	fmt.Printf("Test: Status and watermarks ...\n")
 
-	fmt.Printf("  ... Passed\n")
-	passed++
+	const npaxos = 3
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
 
-	fmt.Printf("Test: All agree after full heal ...\n")
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("status", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxos(pxh, i, nil, false)
+	}
 
-	pxa[0].StartPaxos(seq, 1000) // poke them
-	pxa[4].StartPaxos(seq, 1004)
-	part(t, tag, npaxos, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	pxa[0].StartPaxos(0, value("a"))
+	pxa[0].StartPaxos(1, value("b"))
+	waitn(t, pxa, 0, npaxos)
+	waitn(t, pxa, 1, npaxos)
 
-	waitn(t, pxa, seq, npaxos)
+	if fate, v := pxa[1].Status(1); fate != Decided || string(v) != "b" {
+		t.Fatalf("instance 1: expected Decided b, got %v %v", fate, v)
+	}
+	if fate, _ := pxa[1].Status(5); fate != Pending {
+		t.Fatalf("instance 5: expected Pending, got %v", fate)
+	}
+	if max := pxa[1].MaxID(); max != 1 {
+		t.Fatalf("expected MaxID 1, got %v", max)
+	}
+
+	for i := 0; i < npaxos; i++ {
+		pxa[i].CommitFinished(0)
+	}
+	// watermarks travel with the next round of messages
+	pxa[0].StartPaxos(2, value("c"))
+	waitn(t, pxa, 2, npaxos)
+	pxa[1].StartPaxos(3, value("d"))
+	waitn(t, pxa, 3, npaxos)
+	pxa[2].StartPaxos(4, value("e"))
+	waitn(t, pxa, 4, npaxos)
+
+	for i := 0; i < npaxos; i++ {
+		for address, done := range pxa[i].Watermarks() {
+			if done != 0 {
+				t.Fatalf("node %v: expected watermark 0 for %v, got %v", i, address, done)
+			}
+		}
+		if min := pxa[i].MinID(); min != 1 {
+			t.Fatalf("node %v: expected MinID 1, got %v", i, min)
+		}
+		if fate, _ := pxa[i].Status(0); fate != Forgotten {
+			t.Fatalf("node %v: instance 0 expected Forgotten, got %v", i, fate)
+		}
+	}
 
 	fmt.Printf("  ... Passed\n")
 	passed++
+}
 
+//
+// swap node 0 for a new node 3 from instance 10 on; after that nodes
+// 2 and 3 are a majority even with nodes 0 and 1 gone.
+//
+func TestReconfigure(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Replace a node through Reconfigure ...\n")
+
+	const npaxos = 4
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("reconfig", i)
+	}
+	for i := 0; i < 3; i++ {
+		pxa[i] = NewPaxos(pxh[:3], i, nil, false)
+	}
+	for seq := 0; seq < 5; seq++ {
+		pxa[0].StartPaxos(seq, value(seq*10))
+		waitn(t, pxa, seq, 3)
+	}
+
+	for i := 0; i < 3; i++ {
+		pxa[i].Reconfigure(10, pxh[1:])
+	}
+	// the new node learns the whole history before it takes part
+	pxa[3] = NewPaxos(pxh, 3, nil, false)
+	pxa[3].Reconfigure(0, pxh[:3])
+	pxa[3].Reconfigure(10, pxh[1:])
+
+	if v := pxa[1].voters(9); len(v) != 3 || v[0] != 0 {
+		t.Fatalf("instance 9 should still be decided by nodes 0-2, got %v", v)
+	}
+	if v := pxa[1].voters(10); len(v) != 3 || v[2] != 3 {
+		t.Fatalf("instance 10 should be decided by nodes 1-3, got %v", v)
+	}
+	// node 0 votes up to instance 9, so nothing it has not applied yet
+	// may be forgotten
+	pxa[1].phaseLock.Lock()
+	appliers := pxa[1].appliers()
+	pxa[1].phaseLock.Unlock()
+	if !contains(appliers, 0) {
+		t.Fatalf("node 0 stopped holding back the watermark before instance 10")
+	}
+
+	pxa[0].Close()
+	pxa[0] = nil
+	pxa[1].Close()
+	pxa[1] = nil
+
+	for seq := 10; seq < 15; seq++ {
+		pxa[2].StartPaxos(seq, value(seq*10))
+		waitn(t, pxa, seq, 2)
+	}
+	if _, v := pxa[3].GetLog(14); string(v) != "140" {
+		t.Fatalf("new node has wrong value for 14: %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+//
+// unsafe quorum systems are refused, and a leader that has prepared
+// keeps deciding with any Phase 2 quorum, here one rack of two.
+//
+func TestQuorums(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Flexible, weighted and zone quorums ...\n")
+
+	five := []string{"a", "b", "c", "d", "e"}
+	if (Flexible{2, 3}).Validate(five) == nil {
+		t.Fatalf("Flexible{2, 3} of 5 need not overlap")
+	}
+	if err := (Flexible{4, 2}).Validate(five); err != nil {
+		t.Fatalf("Flexible{4, 2} of 5: %v", err)
+	}
+	if (Weighted{Weights: map[string]int{"a": 3}, Phase1: 3, Phase2: 4}).Validate(five) == nil {
+		t.Fatalf("weights 3+4 of 7 need not overlap")
+	}
+	if !(Weighted{Weights: map[string]int{"a": 3}}).IsQuorum(2, five, []string{"a", "b"}) {
+		t.Fatalf("weight 4 of 7 is a majority")
+	}
+	if (Zones{"r1": {"a", "b"}, "r2": {"c", "d"}}).Validate(five) == nil {
+		t.Fatalf("e is in no zone")
+	}
+
+	const npaxos = 6
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("quorum", i)
+	}
+	zones := Zones{"r1": pxh[0:3], "r2": pxh[3:6]}
+	if NewPaxosWithConfig(pxh, 0, nil, &Config{Quorum: Flexible{3, 3}}) != nil {
+		t.Fatalf("started with quorums that need not overlap")
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxosWithConfig(pxh, i, nil, &Config{Quorum: zones})
+	}
+	if pxa[0].Reconfigure(10, append(pxh, "nowhere")) == nil {
+		t.Fatalf("took a member that is in no zone")
+	}
+
+	pxa[0].StartPaxos(0, value(0))
+	waitn(t, pxa, 0, npaxos)
+
+	// rack r2 goes away, r1 alone still accepts for the leader
+	for i := 3; i < npaxos; i++ {
+		pxa[i].Close()
+		pxa[i] = nil
+	}
+	for seq := 1; seq < 5; seq++ {
+		pxa[0].StartPaxos(seq, value(seq))
+		waitn(t, pxa, seq, 2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+//
+// learners hear every decision but never count toward a quorum.
+//
+func TestLearners(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Learners do not vote ...\n")
+
+	const npaxos = 5
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("learner", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxosWithConfig(pxh, i, nil, &Config{Learners: pxh[3:]})
+	}
+
+	pxa[0].StartPaxos(0, value("x"))
+	waitn(t, pxa, 0, npaxos)
+
+	pxa[1].Close()
+	pxa[1] = nil
+	pxa[2].Close()
+	pxa[2] = nil
+	pxa[0].StartPaxos(1, value("y"))
+	time.Sleep(time.Second)
+	if n := ndecided(t, pxa, 1); n != 0 {
+		t.Fatalf("decided with learners in the quorum; ndecided=%v", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+//
+// a leader holding a lease answers reads alone: nobody else may prepare,
+// values proposed elsewhere are forwarded to it, and the lease moves on
+// once the leader is gone.
+//
+func TestLeases(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Leader leases ...\n")
+
+	const npaxos = 3
+	const lease = 500 * time.Millisecond
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("lease", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxosWithConfig(pxh, i, nil, &Config{Lease: lease})
+	}
+
+	leader := func(stage string) int {
+		for iters := 0; iters < 50; iters++ {
+			for i := 0; i < npaxos; i++ {
+				if pxa[i] == nil {
+					continue
+				}
+				if _, ok := pxa[i].ReadIndex(); ok {
+					return i
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("%v: nobody holds a lease", stage)
+		return -1
+	}
+
+	pxa[0].StartPaxos(0, value("x"))
+	waitn(t, pxa, 0, npaxos)
+	if l := leader("start"); l != 0 {
+		t.Fatalf("lease held by %v, expected 0", l)
+	}
+	for i := 1; i < npaxos; i++ {
+		if _, ok := pxa[i].ReadIndex(); ok {
+			t.Fatalf("%v holds a lease next to the leader", i)
+		}
+	}
+
+	// the grantors refuse everyone else, who hand their values to the leader
+	refused := 0
+	for i := 1; i < npaxos; i++ {
+		reply := &PaxosReply{}
+		pxa[i].Prepare(&PaxosAgrs{Rid: 100, Pid: Ballot{100, 3 - i}, CommitFinished: -1, Self: 3 - i}, reply)
+		if !reply.OK && reply.LeaseHolder == pxh[0] {
+			refused++
+		}
+	}
+	if refused == 0 {
+		t.Fatalf("no grantor refused a Prepare during the lease")
+	}
+	pxa[1].StartPaxos(1, value("y"))
+	waitn(t, pxa, 1, npaxos)
+	if index, _ := pxa[0].ReadIndex(); index < 1 {
+		t.Fatalf("read index %v does not cover instance 1", index)
+	}
+	if _, ok := pxa[0].ReadIndex(); !ok {
+		t.Fatalf("leader lost its lease to a forwarded value")
+	}
+
+	pxa[0].Close()
+	pxa[0] = nil
+	pxa[2].StartPaxos(2, value("z"))
+	waitn(t, pxa, 2, npaxos-1)
+	if l := leader("leader gone"); l != 2 {
+		t.Fatalf("lease held by %v after the leader left, expected 2", l)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+//
+// a peer that accepts connections but never answers must not
+// hold up a round once a majority has replied.
+//
+func TestHungPeer(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Hung peer does not slow down a majority ...\n")
+
+	const npaxos = 3
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("hung", i)
+	}
+	os.Remove(pxh[2])
+	l, err := net.Listen("unix", pxh[2])
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		var held []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				for _, c := range held {
+					c.Close()
+				}
+				return
+			}
+			held = append(held, conn)
+		}
+	}()
+
+	config := &Config{RPCTimeout: 2 * time.Second}
+	pxa[0] = NewPaxosWithConfig(pxh, 0, nil, config)
+	pxa[1] = NewPaxosWithConfig(pxh, 1, nil, config)
+
+	t0 := time.Now()
+	const ninst = 10
+	for seq := 0; seq < ninst; seq++ {
+		pxa[0].StartPaxos(seq, value(seq))
+		waitn(t, pxa, seq, 2)
+	}
+	// one timeout per phase would take 2 * ninst * RPCTimeout
+	if d := time.Since(t0); d > config.RPCTimeout {
+		t.Fatalf("rounds waited for the hung peer; %v agreements took %v", ninst, d)
+	}
+
+	// calls that timed out must not stay blocked on the silent peer;
+	// catching up with it may keep a few under way
+	time.Sleep(config.RPCTimeout + 500*time.Millisecond)
+	buf := make([]byte, 1<<20)
+	if n := strings.Count(string(buf[:runtime.Stack(buf, true)]), "(*dialTransport).Call"); n > 2*npaxos {
+		t.Fatalf("%v calls to the hung peer outlived their timeout", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+//
+// a peer starts up, with proposal, after others decide.
+// then another peer starts, without a proposal.
+//
+func TestOld(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Minority proposal ignored ...\n")
+
+	const npaxos = 5
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("old", i)
+	}
+
+	pxa[1] = NewPaxos(pxh, 1, nil, false)
+	pxa[2] = NewPaxos(pxh, 2, nil, false)
+	pxa[3] = NewPaxos(pxh, 3, nil, false)
+	pxa[1].StartPaxos(1, value(111))
+
+	waitmajority(t, pxa, 1)
+
+	pxa[0] = NewPaxos(pxh, 0, nil, false)
+	pxa[0].StartPaxos(1, value(222))
+
+	waitn(t, pxa, 1, 4)
+
+	if false {
+		pxa[4] = NewPaxos(pxh, 4, nil, false)
+		waitn(t, pxa, 1, npaxos)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+//
+// many agreements, with unreliable RPC
+//
+func TestManyUnreliable(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Many instances, unreliable RPC ...\n")
+
+	const npaxos = 3
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("manyun", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxos(pxh, i, nil, true)
+		pxa[i].StartPaxos(0, value(0))
+	}
+
+	const ninst = 50
+	for seq := 1; seq < ninst; seq++ {
+		// only 3 active instances, to limit the
+		// number of file descriptors.
+		for seq >= 3 && ndecided(t, pxa, seq-3) < npaxos {
+			time.Sleep(20 * time.Millisecond)
+		}
+		for i := 0; i < npaxos; i++ {
+			pxa[i].StartPaxos(seq, value((seq*10)+i))
+		}
+	}
+
+	for {
+		done := true
+		for seq := 1; seq < ninst; seq++ {
+			if ndecided(t, pxa, seq) < npaxos {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+//
+// two proposers that pick the same round still send different ballots.
+//
+func TestBallotCollision(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Colliding rounds never share a ballot ...\n")
+
+	const npaxos = 3
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("collide", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxos(pxh, i, nil, false)
+	}
+
+	// nodes 1 and 2 both start at round 0 on the same acceptor
+	b1 := NilBallot.Next(1)
+	b2 := NilBallot.Next(2)
+	if b1 == b2 || b1.Round != b2.Round {
+		t.Fatalf("expected distinct ballots in the same round; b1=%v b2=%v", b1, b2)
+	}
+	reply := &PaxosReply{}
+	pxa[0].Prepare(&PaxosAgrs{Rid: 0, Pid: b1, CommitFinished: -1, Self: 1}, reply)
+	if !reply.OK {
+		t.Fatalf("first Prepare refused")
+	}
+	reply = &PaxosReply{}
+	pxa[0].Prepare(&PaxosAgrs{Rid: 0, Pid: b2, CommitFinished: -1, Self: 2}, reply)
+	if !reply.OK {
+		t.Fatalf("higher ballot in the same round refused")
+	}
+	reply = &PaxosReply{}
+	pxa[0].Accept(&PaxosAgrs{Rid: 0, Pid: b1, CommitFinished: -1, Self: 1, V_a: value("one")}, reply)
+	if reply.OK {
+		t.Fatalf("acceptor took a value from a ballot it had superseded")
+	}
+	reply = &PaxosReply{}
+	pxa[0].Accept(&PaxosAgrs{Rid: 0, Pid: b2, CommitFinished: -1, Self: 2, V_a: value("two")}, reply)
+	if !reply.OK {
+		t.Fatalf("acceptor refused the promised ballot")
+	}
+
+	// dueling proposers from a cold start all begin at round 0
+	for seq := 1; seq < 10; seq++ {
+		for i := 0; i < npaxos; i++ {
+			go pxa[i].StartPaxos(seq, value((seq*10)+i))
+		}
+	}
+	for seq := 1; seq < 10; seq++ {
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+func TestDuelingProposers(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Dueling proposers back off and defer ...\n")
+
+	const npaxos = 5
+	const nseq = 20
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("duel", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxosWithConfig(pxh, i, nil, &Config{Backoff: 5 * time.Millisecond, MaxBackoff: 200 * time.Millisecond})
+	}
+
+	// the wait grows with every failed round, but never past the cap
+	for attempt := 0; attempt < 40; attempt++ {
+		d := pxa[0].backoff(attempt)
+		if d < 5*time.Millisecond/2 || d > 200*time.Millisecond {
+			t.Fatalf("backoff %v after %v rounds", d, attempt)
+		}
+	}
+
+	// a higher ballot that was just accepted for an instance is deferred to
+	reply := &PaxosReply{}
+	pxa[0].Accept(&PaxosAgrs{Rid: 100, Pid: Ballot{7, 1}, CommitFinished: -1, Self: 1, V_a: value("a")}, reply)
+	if !reply.OK {
+		t.Fatalf("Accept refused")
+	}
+	if !pxa[0].deferTo(100, NilBallot) || !pxa[0].deferTo(100, Ballot{6, 0}) {
+		t.Fatalf("did not defer to an active higher ballot")
+	}
+	if pxa[0].deferTo(101, NilBallot) || pxa[0].deferTo(100, Ballot{8, 0}) {
+		t.Fatalf("deferred to a ballot that does not compete")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if pxa[0].deferTo(100, NilBallot) {
+		t.Fatalf("deferred to a proposer that went quiet")
+	}
+
+	// every node proposes every instance at once
+	start := time.Now()
+	for seq := 0; seq < nseq; seq++ {
+		for i := 0; i < npaxos; i++ {
+			go pxa[i].StartPaxos(seq, value((seq*10)+i))
+		}
+	}
+	for seq := 0; seq < nseq; seq++ {
+		waitn(t, pxa, seq, npaxos)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("%v instances took %v to decide", nseq, elapsed)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+func store(tag string, host int) string {
+	return port(tag, host) + "-store"
+}
+
+func openStore(t *testing.T, tag string, host int) Store {
+	st, err := NewFileStore(store(tag, host))
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	return st
+}
+
+//
+// a crashed node comes back with its promises and accepted values.
+//
+func TestRestart(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Restarted acceptor keeps its promises ...\n")
+
+	tag := "restart"
+	const npaxos = 3
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port(tag, i)
+		os.Remove(store(tag, i))
+		defer os.Remove(store(tag, i))
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = NewPaxosWithConfig(pxh, i, nil, &Config{Store: openStore(t, tag, i)})
+	}
+
+	pxa[0].StartPaxos(0, value("before"))
+	waitn(t, pxa, 0, npaxos)
+
+	// promise a high proposal number on instance 1, then crash
+	prepare := &PaxosAgrs{Rid: 1, Pid: Ballot{50, 2}, CommitFinished: -1, Self: 2}
+	if err := pxa[1].Prepare(prepare, &PaxosReply{}); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	accept := &PaxosAgrs{Rid: 2, Pid: Ballot{60, 2}, CommitFinished: -1, Self: 2, V_a: value("accepted")}
+	if err := pxa[1].Accept(accept, &PaxosReply{}); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	pxa[1].Close()
+	pxa[1] = NewPaxosWithConfig(pxh, 1, nil, &Config{Store: openStore(t, tag, 1)})
+
+	if decided, v := pxa[1].GetLog(0); !decided || string(v) != "before" {
+		t.Fatalf("restarted node forgot a decision; decided=%v v=%v", decided, v)
+	}
+
+	// a lower proposal must still be refused after the restart
+	reply := &PaxosReply{}
+	stale := &PaxosAgrs{Rid: 1, Pid: Ballot{10, 0}, CommitFinished: -1, Self: 0, V_a: value("stale")}
+	pxa[1].Accept(stale, reply)
+	if reply.OK {
+		t.Fatalf("restarted node broke its promise")
+	}
+
+	// and a new proposer must learn the accepted value
+	reply = &PaxosReply{}
+	prepare = &PaxosAgrs{Rid: 2, Pid: Ballot{70, 0}, CommitFinished: -1, Self: 0}
+	pxa[1].Prepare(prepare, reply)
+	if !reply.OK || reply.N_a != (Ballot{60, 2}) || string(reply.V_a) != "accepted" {
+		t.Fatalf("restarted node lost its accepted value; reply=%+v", reply)
+	}
+
+	pxa[2].StartPaxos(3, value("after"))
+	waitn(t, pxa, 3, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+}
+
+func pp(tag string, src int, dst int) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	s += "px-" + tag + "-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += strconv.Itoa(src) + "-"
+	s += strconv.Itoa(dst)
+	return s
+}
+
+func cleanpp(tag string, n int) {
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			ij := pp(tag, i, j)
+			os.Remove(ij)
+		}
+	}
+}
+
+func part(t *testing.T, tag string, npaxos int, p1 []int, p2 []int, p3 []int) {
+	cleanpp(tag, npaxos)
+
+	pa := [][]int{p1, p2, p3}
+	for pi := 0; pi < len(pa); pi++ {
+		p := pa[pi]
+		for i := 0; i < len(p); i++ {
+			for j := 0; j < len(p); j++ {
+				ij := pp(tag, p[i], p[j])
+				pj := port(tag, p[j])
+				err := os.Link(pj, ij)
+				if err != nil {
+					// one reason this link can fail is if the
+					// corresponding paxos peer has prematurely quit and
+					// deleted its socket file (e.g., called px.Close()).
+					t.Fatalf("os.Link(%v, %v): %v\n", pj, ij, err)
+				}
+			}
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "partition"
+	const npaxos = 5
+	var pxa []*paxos = make([]*paxos, npaxos)
+	defer cleanup(pxa)
+	defer cleanpp(tag, npaxos)
+
+	for i := 0; i < npaxos; i++ {
+		var pxh []string = make([]string, npaxos)
+		for j := 0; j < npaxos; j++ {
+			if j == i {
+				pxh[j] = port(tag, i)
+			} else {
+				pxh[j] = pp(tag, i, j)
+			}
+		}
+		pxa[i] = NewPaxos(pxh, i, nil, false)
+	}
+	defer part(t, tag, npaxos, []int{}, []int{}, []int{})
+
+	seq := 0
+
+	fmt.Printf("Test: No decision if partitioned ...\n")
+
+	part(t, tag, npaxos, []int{0, 2}, []int{1, 3}, []int{4})
+	pxa[1].StartPaxos(seq, value(111))
+	checkmax(t, pxa, seq, 0)
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+
+	fmt.Printf("Test: Decision in majority partition ...\n")
+
+	part(t, tag, npaxos, []int{0}, []int{1, 2, 3}, []int{4})
+	time.Sleep(2 * time.Second)
+	waitmajority(t, pxa, seq)
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+
+	fmt.Printf("Test: All agree after full heal ...\n")
+
+	pxa[0].StartPaxos(seq, value(1000)) // poke them
+	pxa[4].StartPaxos(seq, value(1004))
+	part(t, tag, npaxos, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+
+	waitn(t, pxa, seq, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+
+}
+
+//
+// a node cut off while others decide must catch up once it can be
+// reached again, and a node that lost its state must fill the gap
+// as soon as it hears of a later decision, both without proposing.
+//
+func TestCatchUp(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "catchup"
+	const npaxos = 3
+	var pxa []*paxos = make([]*paxos, npaxos)
+	var pxh [][]string = make([][]string, npaxos)
+	defer cleanup(pxa)
+	defer cleanpp(tag, npaxos)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = make([]string, npaxos)
+		for j := 0; j < npaxos; j++ {
+			if j == i {
+				pxh[i][j] = port(tag, i)
+			} else {
+				pxh[i][j] = pp(tag, i, j)
+			}
+		}
+		pxa[i] = NewPaxos(pxh[i], i, nil, false)
+	}
+	defer part(t, tag, npaxos, []int{}, []int{}, []int{})
+
+	fmt.Printf("Test: Partitioned node catches up after heal ...\n")
+
+	part(t, tag, npaxos, []int{0, 1}, []int{2}, []int{})
+	const ninst = 10
+	for seq := 0; seq < ninst; seq++ {
+		pxa[0].StartPaxos(seq, value(seq*10))
+		waitn(t, pxa, seq, 2)
+	}
+	part(t, tag, npaxos, []int{0, 1, 2}, []int{}, []int{})
+	for seq := 0; seq < ninst; seq++ {
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+
+	fmt.Printf("Test: Restarted node fetches what it lost ...\n")
+
+	pxa[2].Close()
+	pxa[2] = NewPaxos(pxh[2], 2, nil, false)
+	part(t, tag, npaxos, []int{0, 1, 2}, []int{}, []int{})
+	pxa[0].StartPaxos(ninst, value(ninst*10))
+	waitn(t, pxa, ninst, npaxos)
+	for seq := 0; seq < ninst; seq++ {
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
+
+	fmt.Printf("Test: Lagging node catches up without the proposer ...\n")
+
+	// the proposer goes away with the Commits it still owed node 2
+	part(t, tag, npaxos, []int{0, 1}, []int{2}, []int{})
+	for seq := ninst + 1; seq < 2*ninst; seq++ {
+		pxa[0].StartPaxos(seq, value(seq*10))
+		waitn(t, pxa, seq, 2)
+	}
+	pxa[0].Close()
+	pxa[0] = nil
+	part(t, tag, npaxos, []int{1, 2}, []int{}, []int{})
+	pxa[1].StartPaxos(2*ninst, value(2*ninst*10))
+	for seq := ninst + 1; seq <= 2*ninst; seq++ {
+		waitn(t, pxa[1:], seq, npaxos-1)
+	}
+
+	fmt.Printf("  ... Passed\n")
+	passed++
 }
 
 func TestLots(t *testing.T) {
@@ -743,7 +1786,7 @@ func TestLots(t *testing.T) {
 				pxh[j] = pp(tag, i, j)
 			}
 		}
-		pxa[i] = NewPaxos(pxh, i, nil)
+		pxa[i] = NewPaxos(pxh, i, nil, false)
 	}
 	defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 
@@ -788,7 +1831,7 @@ func TestLots(t *testing.T) {
 			}
 			if seq-nd < 10 {
 				for i := 0; i < npaxos; i++ {
-					pxa[i].StartPaxos(seq, rand.Int()%10)
+					pxa[i].StartPaxos(seq, value(rand.Int()%10))
 				}
 				seq++
 			}
@@ -825,5 +1868,5 @@ func TestLots(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 	passed++
 
-	fmt.Printf(" ...... Passed the tests(%d/16)\n", passed)
+	fmt.Printf(" ...... Passed the tests(%d/34)\n", passed)
 }
@@ -0,0 +1,224 @@
+package paxos
+
+import "bufio"
+import "encoding/json"
+import "io"
+import "os"
+import "sort"
+import "strconv"
+import "sync"
+import "time"
+
+// EventKind is one step of the protocol.
+type EventKind string
+
+const (
+	EventPrepare  EventKind = "Prepare"  // a proposer asks Peer to promise
+	EventPromise  EventKind = "Promise"  // this acceptor promised Peer
+	EventAccept   EventKind = "Accept"   // a proposer asks Peer to accept
+	EventAccepted EventKind = "Accepted" // this acceptor accepted from Peer
+	EventCommit   EventKind = "Commit"   // this node learned the decision from Peer
+	EventReject   EventKind = "Reject"   // this acceptor refused a Prepare or Accept of Peer
+)
+
+// Event is what a node records about one protocol step. Node is the node
+// that recorded it, Peer the one on the other side.
+type Event struct {
+	Time     time.Time
+	Node     string
+	Kind     EventKind
+	Rid      int
+	Ballot   Ballot
+	Peer     string
+	Of       EventKind `json:",omitempty"` // Reject: the message refused
+	Promised Ballot    // Reject: the promise that beat Ballot
+}
+
+// Tracer receives the events of a node in order, from a goroutine of the
+// node that runs apart from the protocol, so a slow Tracer only holds up
+// the events after it.
+type Tracer interface {
+	Trace(e Event)
+}
+
+// TraceFunc lets a plain function be a Tracer.
+type TraceFunc func(e Event)
+
+func (f TraceFunc) Trace(e Event) {
+	f(e)
+}
+
+// trace queues an event for the tracer of this node, if it has one.
+func (px *paxos) trace(kind EventKind, rid int, ballot Ballot, peer string) {
+	if px.tracer != nil {
+		px.queueEvent(Event{Time: px.clock.Now(), Node: px.name, Kind: kind, Rid: rid, Ballot: ballot, Peer: peer})
+	}
+}
+
+// traceReject records that a message of kind from peer lost to promised.
+func (px *paxos) traceReject(kind EventKind, rid int, ballot Ballot, peer string, promised Ballot) {
+	if px.tracer != nil {
+		px.queueEvent(Event{Time: px.clock.Now(), Node: px.name, Kind: EventReject, Rid: rid, Ballot: ballot, Peer: peer, Of: kind, Promised: promised})
+	}
+}
+
+// queueEvent buffers e for emit. Callers may hold phaseLock; the tracer
+// never runs under it.
+func (px *paxos) queueEvent(e Event) {
+	px.traceLock.Lock()
+	px.traced = append(px.traced, e)
+	px.traceLock.Unlock()
+	select {
+	case px.traceReady <- struct{}{}:
+	default:
+	}
+}
+
+// emit hands the queued events to the tracer until the node is closed.
+func (px *paxos) emit() {
+	if px.tracer == nil {
+		return
+	}
+	for {
+		select {
+		case <-px.traceReady:
+			px.flushEvents()
+		case <-px.ctx.Done():
+			px.flushEvents()
+			return
+		}
+	}
+}
+
+func (px *paxos) flushEvents() {
+	px.traceLock.Lock()
+	events := px.traced
+	px.traced = nil
+	px.traceLock.Unlock()
+	for _, e := range events {
+		px.tracer.Trace(e)
+	}
+}
+
+// peer names node id for a trace, "" if this node does not know it yet.
+// The caller holds phaseLock.
+func (px *paxos) peer(id int) string {
+	if px.tracer == nil || id < 0 || id >= len(px.nodes) {
+		return ""
+	}
+	return px.nodes[id]
+}
+
+// JSONTracer writes one JSON object per event and line. Several nodes
+// may share one.
+type JSONTracer struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{encoder: json.NewEncoder(w)}
+}
+
+// CreateTraceFile writes events to a new file at path.
+func CreateTraceFile(path string) (*JSONTracer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	t := NewJSONTracer(f)
+	t.closer = f
+	return t, nil
+}
+
+func (t *JSONTracer) Trace(e Event) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.encoder.Encode(e)
+}
+
+// Close closes the file of CreateTraceFile; it does nothing otherwise.
+func (t *JSONTracer) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closer == nil {
+		return nil
+	}
+	return t.closer.Close()
+}
+
+// ReadTrace reads back what a JSONTracer wrote.
+func ReadTrace(r io.Reader) ([]Event, error) {
+	events := []Event{}
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var e Event
+		err := decoder.Decode(&e)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+}
+
+// chromeEvent is one entry of the Chrome trace-event format, see
+// chrome://tracing or https://ui.perfetto.dev.
+type chromeEvent struct {
+	Name  string                 `json:"name"`
+	Cat   string                 `json:"cat,omitempty"`
+	Phase string                 `json:"ph"`
+	Scope string                 `json:"s,omitempty"`
+	TS    int64                  `json:"ts"`
+	PID   int                    `json:"pid"`
+	TID   int                    `json:"tid"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+// WriteChromeTrace writes events in the Chrome trace-event format. Every
+// instance becomes a process and every node a thread in it, so the
+// timeline of one instance shows each node's part in it side by side.
+func WriteChromeTrace(w io.Writer, events []Event) error {
+	events = append([]Event{}, events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	tids := map[string]int{}
+	nodes := []string{}
+	seen := map[int]bool{}
+	rids := []int{}
+	out := []chromeEvent{}
+	for _, e := range events {
+		tid, found := tids[e.Node]
+		if !found {
+			nodes = append(nodes, e.Node)
+			tid = len(nodes)
+			tids[e.Node] = tid
+		}
+		if !seen[e.Rid] {
+			seen[e.Rid] = true
+			rids = append(rids, e.Rid)
+			out = append(out, chromeEvent{Name: "process_name", Phase: "M", PID: e.Rid,
+				Args: map[string]interface{}{"name": "instance " + strconv.Itoa(e.Rid)}})
+		}
+		args := map[string]interface{}{"ballot": e.Ballot, "peer": e.Peer}
+		name := string(e.Kind)
+		if e.Kind == EventReject {
+			name += " " + string(e.Of)
+			args["promised"] = e.Promised
+		}
+		out = append(out, chromeEvent{Name: name, Cat: "paxos", Phase: "i", Scope: "t",
+			TS: e.Time.Sub(events[0].Time).Nanoseconds() / 1000, PID: e.Rid, TID: tid, Args: args})
+	}
+	// name the threads of every instance after the nodes
+	for _, rid := range rids {
+		for i, node := range nodes {
+			out = append(out, chromeEvent{Name: "thread_name", Phase: "M", PID: rid, TID: i + 1,
+				Args: map[string]interface{}{"name": node}})
+		}
+	}
+	return json.NewEncoder(w).Encode(map[string]interface{}{"traceEvents": out, "displayTimeUnit": "ms"})
+}
@@ -3,6 +3,9 @@ package server
 type Server interface {
 	Get(args *GetArgs, reply *GetReply) error
 	Put(args *PutArgs, reply *PutReply) error
+	AddNode(args *MembershipArgs, reply *MembershipReply) error
+	RemoveNode(args *MembershipArgs, reply *MembershipReply) error
+	SetLink(args *LinkArgs, reply *LinkReply) error
 	Close()
 	StorageSize() int
 }
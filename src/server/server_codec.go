@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Codec turns a log entry into the bytes paxos agrees on and back. Every
+// value starts with the Tag of the codec that wrote it, and every server
+// reads every codec it knows, so servers set up with different codecs,
+// or a cluster half way through switching, still share one log.
+type Codec interface {
+	Tag() byte
+	Encode(b Batch) ([]byte, error)
+	Decode(data []byte) (Batch, error)
+}
+
+// the tags are part of the log format: never reuse one, add a new tag
+// for a new format or a changed one
+const (
+	gobTag    byte = 1
+	jsonTag   byte = 2
+	binaryTag byte = 3
+)
+
+var GobCodec Codec = gobCodec{}
+var JSONCodec Codec = jsonCodec{}
+var BinaryCodec Codec = binaryCodec{}
+
+var codecs = map[byte]Codec{
+	gobTag:    GobCodec,
+	jsonTag:   JSONCodec,
+	binaryTag: BinaryCodec,
+}
+
+var errTruncated = errors.New("codec: value is cut short")
+
+// encodeBatch writes b in codec, behind its tag.
+func encodeBatch(codec Codec, b Batch) ([]byte, error) {
+	data, err := codec.Encode(b)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.Tag()}, data...), nil
+}
+
+// decodeBatch reads a value written by any known codec.
+func decodeBatch(data []byte) (Batch, error) {
+	if len(data) == 0 {
+		return Batch{}, errTruncated
+	}
+	codec, found := codecs[data[0]]
+	if !found {
+		return Batch{}, errors.New("codec: unknown tag " + strconv.Itoa(int(data[0])))
+	}
+	return codec.Decode(data[1:])
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Tag() byte {
+	return gobTag
+}
+
+func (gobCodec) Encode(b Batch) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(b)
+	return buffer.Bytes(), err
+}
+
+func (gobCodec) Decode(data []byte) (Batch, error) {
+	var b Batch
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&b)
+	return b, err
+}
+
+// jsonCodec keeps the log readable; like any JSON it turns strings that
+// are not valid UTF-8 into replacement characters.
+type jsonCodec struct{}
+
+func (jsonCodec) Tag() byte {
+	return jsonTag
+}
+
+func (jsonCodec) Encode(b Batch) ([]byte, error) {
+	return json.Marshal(b)
+}
+
+func (jsonCodec) Decode(data []byte) (Batch, error) {
+	var b Batch
+	err := json.Unmarshal(data, &b)
+	return b, err
+}
+
+// binaryCodec writes varints and length-prefixed strings, field by field:
+// Server, BatchID, the number of requests, then for every request its
+// AgentID, RequestID, Name, Key and Value.
+type binaryCodec struct{}
+
+func (binaryCodec) Tag() byte {
+	return binaryTag
+}
+
+func (binaryCodec) Encode(b Batch) ([]byte, error) {
+	data := make([]byte, 0, 32+len(b.Requests)*32)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	putInt := func(v int64) {
+		data = append(data, scratch[:binary.PutVarint(scratch, v)]...)
+	}
+	putString := func(s string) {
+		data = append(data, scratch[:binary.PutUvarint(scratch, uint64(len(s)))]...)
+		data = append(data, s...)
+	}
+	putInt(int64(b.Server))
+	putInt(b.BatchID)
+	putInt(int64(len(b.Requests)))
+	for _, r := range b.Requests {
+		putInt(int64(r.AgentID))
+		putInt(r.RequestID)
+		putString(r.Name)
+		putString(r.Key)
+		putString(r.Value)
+	}
+	return data, nil
+}
+
+func (binaryCodec) Decode(data []byte) (Batch, error) {
+	var err error
+	getInt := func() int64 {
+		v, n := binary.Varint(data)
+		if n <= 0 {
+			err = errTruncated
+			return 0
+		}
+		data = data[n:]
+		return v
+	}
+	getString := func() string {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			err = errTruncated
+			return ""
+		}
+		s := string(data[n : n+int(l)])
+		data = data[n+int(l):]
+		return s
+	}
+
+	var b Batch
+	b.Server = int(getInt())
+	b.BatchID = getInt()
+	count := getInt()
+	for i := int64(0); i < count && err == nil; i++ {
+		r := Request{}
+		r.AgentID = int(getInt())
+		r.RequestID = getInt()
+		r.Name = getString()
+		r.Key = getString()
+		r.Value = getString()
+		b.Requests = append(b.Requests, r)
+	}
+	return b, err
+}
@@ -1,66 +1,245 @@
 package server
 
 import (
-	"encoding/gob"
 	"errors"
 	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"paxos"
+	"shard"
+	"sim"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"transport"
 )
 
 type server struct {
-	allHostPorts []string
-	self         int
-	rid          int
-	p            paxos.Paxos
-	storage      map[string]string
-	ridLock      *sync.Mutex
-	storageLock  *sync.Mutex
-	closeLock    *sync.Mutex
-	listener     net.Listener
-	closed       bool
-	needFile     bool
-	fileName     string
+	allHostPorts  []string // every server ever added, a server's index never changes
+	memberships   []Membership
+	self          int
+	rid           int // next log entry to apply
+	nextRid       int // next log entry this server proposes into
+	ridCond       *sync.Cond
+	decisions     <-chan paxos.Decision
+	applied       int // client requests applied so far
+	waiters       map[int]chan applied
+	incoming      chan pending
+	maxBatchSize  int
+	batchDelay    time.Duration
+	batchID       int64
+	codec         Codec
+	clock         sim.Clock
+	done          chan struct{}
+	p             paxos.Paxos
+	storage       map[string]string
+	ridLock       *sync.Mutex
+	storageLock   *sync.Mutex
+	closeLock     *sync.Mutex
+	listener      net.Listener
+	conns         map[net.Conn]bool
+	closed        bool
+	learner       bool
+	learners      []string // never members, see Config.Learners
+	witness       bool
+	needFile      bool
+	fileName      string
+	logDir        string
+	snapshotRid   int // first log entry not covered by the snapshot on disk
+	snapshotEvery int
+	transport     transport.Transport
+	ownTransport  bool
+	faults        *transport.Faulty // wraps transport, see SetLink
+	metrics       net.Listener      // serves Config.MetricsAddress, nil if not set
+	gid           int
+	clerk         *shard.Clerk  // nil unless the cluster is sharded
+	shards        shard.Config  // the last config applied
+	seen          map[int]int64 // last Put RequestID of every agent
+	arriving      map[int]bool  // shards of this group not installed yet
+	leaving       []Migration   // shards frozen here until their group has them
 }
 
+// what applying a log entry produced, handed to the request waiting on it
+type result struct {
+	value string
+	ok    bool
+	err   error // ErrClosed if the server closed before the entry applied, or why it could not be encoded
+}
+
+type applied struct {
+	batch   Batch
+	results []result
+}
+
+// a client request waiting for the batcher
+type pending struct {
+	request Request
+	wait    chan result
+}
+
+const DefaultMaxBatchSize = 64
+
+// how long the next entry may stay undecided before applier fills it
+const fillDelay = 500 * time.Millisecond
+
+// a membership change applied at entry rid takes over at rid+Alpha, so
+// no server may propose more than Alpha entries past what it has applied
+const Alpha = 32
+
+const DefaultSnapshotEvery = 1000
+
+var errWitness = errors.New("a witness keeps no key-value state")
+
+// ErrClosed is what requests still waiting when the server closes get.
+var ErrClosed = errors.New("server closed")
+
 func NewServer(allHostPorts []string, self int, isDebug bool, needFile bool) (Server, error) {
-	gob.Register(Request{})
-	s := &server{
-		allHostPorts: allHostPorts,
-		self:         self,
-		rid:          0,
-		storage:      make(map[string]string),
-		ridLock:      new(sync.Mutex),
-		storageLock:  new(sync.Mutex),
-		closeLock:    new(sync.Mutex),
-		closed:       false,
-		needFile:     needFile,
-		fileName:     "../logs/log_" + allHostPorts[self],
-	}
-	if needFile {
+	return NewServerWithConfig(allHostPorts, self, &Config{IsDebug: isDebug, NeedFile: needFile})
+}
+
+func NewServerWithConfig(allHostPorts []string, self int, config *Config) (Server, error) {
+	s := newServer(allHostPorts, self, config)
+	if s.needFile {
+		if err := s.loadSnapshot(); err != nil {
+			return nil, err
+		}
 		if _, err := os.Stat(s.fileName); os.IsNotExist(err) {
 			s.writeFile(os.O_CREATE|os.O_TRUNC|os.O_RDWR, "Server: "+allHostPorts[self]+"\n")
 		} else {
 			s.recovery()
 		}
 	}
+	if err := s.start(config); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newServer(allHostPorts []string, self int, config *Config) *server {
+	clock := config.Clock
+	if clock == nil {
+		clock = sim.Wall
+	}
+	s := &server{
+		allHostPorts: append([]string{}, allHostPorts...),
+		memberships:  []Membership{{0, without(allHostPorts, config.Learners)}},
+		self:         self,
+		rid:          0,
+		waiters:      make(map[int]chan applied),
+		incoming:     make(chan pending),
+		maxBatchSize: config.MaxBatchSize,
+		batchDelay:   config.BatchDelay,
+		// restarts must not reuse the ids of batches still in the log
+		batchID:       clock.Now().UnixNano(),
+		codec:         config.Codec,
+		clock:         clock,
+		done:          make(chan struct{}),
+		storage:       make(map[string]string),
+		seen:          make(map[int]int64),
+		arriving:      make(map[int]bool),
+		ridLock:       new(sync.Mutex),
+		storageLock:   new(sync.Mutex),
+		closeLock:     new(sync.Mutex),
+		conns:         make(map[net.Conn]bool),
+		closed:        false,
+		learner:       contains(config.Learners, allHostPorts[self]),
+		learners:      config.Learners,
+		witness:       contains(config.Witnesses, allHostPorts[self]),
+		needFile:      config.NeedFile,
+		logDir:        config.LogDir,
+		snapshotEvery: config.SnapshotEvery,
+		transport:     config.Transport,
+	}
+	if s.logDir == "" {
+		s.logDir = "../logs"
+	}
+	s.fileName = s.logDir + "/log_" + allHostPorts[self]
+	if s.snapshotEvery <= 0 {
+		s.snapshotEvery = DefaultSnapshotEvery
+	}
+	s.ridCond = sync.NewCond(s.ridLock)
+	if s.codec == nil {
+		s.codec = GobCodec
+	}
+	if s.maxBatchSize <= 0 {
+		s.maxBatchSize = DefaultMaxBatchSize
+	}
+	if s.transport == nil {
+		s.transport = transport.Default(allHostPorts[self])
+		s.ownTransport = true
+	}
+	s.faults = transport.NewFaulty(s.transport, config.Seed)
+	s.faults.SetClock(s.clock)
+	s.transport = s.faults
+	if len(config.Controllers) > 0 {
+		s.gid = config.GID
+		s.clerk = shard.NewClerk(config.Controllers, s.transport)
+	}
+	return s
+}
+
+// start brings up paxos from the state recovered or fetched so far and
+// begins serving.
+func (s *server) start(config *Config) error {
+	address := s.allHostPorts[s.self]
+	paxosConfig := &paxos.Config{
+		IsDebug:   config.IsDebug,
+		Seed:      config.Seed,
+		Clock:     s.clock,
+		Transport: s.transport,
+		Quorum:    config.Quorum,
+		Learners:  config.Learners,
+		Lease:     config.Lease,
+		Drift:     config.Drift,
+
+		Backoff:    config.Backoff,
+		MaxBackoff: config.MaxBackoff,
+		Tracer:     config.Tracer,
+	}
+	if s.needFile {
+		// acceptor promises must survive a restart along with the log
+		store, err := paxos.NewFileStore(s.logDir + "/paxos_" + address)
+		if err != nil {
+			return err
+		}
+		paxosConfig.Store = store
+	}
 	newRpc := rpc.NewServer()
-	p := paxos.NewPaxos(allHostPorts, self, newRpc, isDebug)
+	p := paxos.NewPaxosWithConfig(s.allHostPorts, s.self, newRpc, paxosConfig)
+	if p == nil {
+		return errors.New("could not start paxos")
+	}
+	for _, m := range s.memberships {
+		p.Reconfigure(m.From, m.Members)
+	}
+	if s.rid > 0 {
+		p.CommitFinished(s.rid - 1)
+	}
+	s.decisions = p.Subscribe(s.rid)
 	s.p = p
 	err := newRpc.RegisterName("Server", Wrap(s))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	s.listener, err = net.Listen("tcp", allHostPorts[self])
+	s.listener, err = s.transport.Listen(address)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if config.MetricsAddress != "" {
+		if err := s.serveMetrics(config.MetricsAddress); err != nil {
+			s.listener.Close()
+			return err
+		}
+	}
+
+	go s.applier()
+	go s.batcher()
+	if s.clerk != nil {
+		go s.watchShards()
 	}
 
 	go func() {
@@ -68,72 +247,80 @@ func NewServer(allHostPorts []string, self int, isDebug bool, needFile bool) (Se
 			conn, err := s.listener.Accept()
 			s.closeLock.Lock()
 			if err == nil && !s.closed {
+				// pooled peers keep connections open, so Close has to end them
+				s.conns[conn] = true
 				go newRpc.ServeConn(conn)
 			} else if err == nil {
 				conn.Close()
 			} else if s.closed {
+				s.closeLock.Unlock()
 				break
 			}
 			s.closeLock.Unlock()
 		}
 	}()
-	return s, nil
+	return nil
 }
 
 func (s *server) Get(args *GetArgs, reply *GetReply) error {
-	s.ridLock.Lock()
-	defer s.ridLock.Unlock()
+	if s.witness {
+		return errWitness
+	}
+	if err := s.keyErr(args.Key); err != nil {
+		return err
+	}
+	if s.learner {
+		// a learner answers from its own copy, which may lag behind
+		s.storageLock.Lock()
+		reply.Value, reply.OK = s.storage[args.Key]
+		s.storageLock.Unlock()
+		reply.AgentID = args.AgentID
+		reply.RequestID = args.RequestID
+		if !reply.OK {
+			return errors.New("Could not find the Key in storage")
+		}
+		return nil
+	}
+	if index, ok := s.p.ReadIndex(); ok {
+		// this server leads under a lease: nothing past index is decided
+		// anywhere, so once it has applied that far its copy is current
+		s.ridLock.Lock()
+		for s.rid <= index && !s.isClosed() {
+			s.ridCond.Wait()
+		}
+		if s.rid <= index {
+			s.ridLock.Unlock()
+			return ErrClosed
+		}
+		if err := s.shardErr(args.Key); err != nil {
+			s.ridLock.Unlock()
+			return err
+		}
+		s.storageLock.Lock()
+		reply.Value, reply.OK = s.storage[args.Key]
+		s.storageLock.Unlock()
+		s.ridLock.Unlock()
+		reply.AgentID = args.AgentID
+		reply.RequestID = args.RequestID
+		if !reply.OK {
+			return errors.New("Could not find the Key in storage")
+		}
+		return nil
+	}
 	r := Request{}
 	r.AgentID = args.AgentID
 	r.RequestID = args.RequestID
 	r.Name = "Get"
 	r.Key = args.Key
-	reply.OK = true
 
-	for {
-		// start a new round of paxos
-		s.p.StartPaxos(s.rid, r)
-		var new_r Request
-		// get log
-		for {
-			commit, log_r := s.p.GetLog(s.rid)
-			if commit {
-				new_r = log_r.(Request)
-				break
-			} else {
-				time.Sleep(10 * time.Millisecond)
-			}
-		}
-		// if get another r, means this round has been performed by other paxos node
-		// and it should catch up with other
-		if s.needFile {
-			s.writeFile(os.O_APPEND|os.O_RDWR, s.genText(new_r))
-		}
-		if new_r.Name == "Put" {
-			s.storageLock.Lock()
-			s.storage[new_r.Key] = new_r.Value
-			s.storageLock.Unlock()
-		}
-		if new_r.RequestID == r.RequestID && new_r.AgentID == r.AgentID {
-			s.storageLock.Lock()
-			if v, ok := s.storage[r.Key]; ok {
-				s.storageLock.Unlock()
-				reply.AgentID = r.AgentID
-				reply.RequestID = r.RequestID
-				reply.Value = v
-				break
-			} else {
-				s.storageLock.Unlock()
-				reply.AgentID = r.AgentID
-				reply.RequestID = r.RequestID
-				reply.OK = false
-				break
-			}
-		}
-		s.rid++
+	result := s.submit(r)
+	if result.err != nil {
+		return result.err
 	}
-	s.p.CommitFinished(s.rid)
-	s.rid++
+	reply.AgentID = r.AgentID
+	reply.RequestID = r.RequestID
+	reply.Value = result.value
+	reply.OK = result.ok
 	if reply.OK {
 		return nil
 	} else {
@@ -143,62 +330,284 @@ func (s *server) Get(args *GetArgs, reply *GetReply) error {
 }
 
 func (s *server) Put(args *PutArgs, reply *PutReply) error {
-
-	s.ridLock.Lock()
-	defer s.ridLock.Unlock()
+	if s.witness {
+		return errWitness
+	}
+	if err := s.keyErr(args.Key); err != nil {
+		return err
+	}
 	r := Request{}
 	r.AgentID = args.AgentID
 	r.RequestID = args.RequestID
 	r.Name = "Put"
 	r.Key = args.Key
 	r.Value = args.Value
+
+	if result := s.submit(r); result.err != nil {
+		return result.err
+	}
+	reply.AgentID = r.AgentID
+	reply.RequestID = r.RequestID
 	reply.OK = true
+	return nil
 
-	
+}
 
+// submit hands r to the batcher and waits until the log entry that
+// carries it has been applied, or the server closes.
+func (s *server) submit(r Request) result {
+	wait := make(chan result, 1)
+	select {
+	case s.incoming <- pending{r, wait}:
+	case <-s.done:
+		return result{err: ErrClosed}
+	}
+	select {
+	case res := <-wait:
+		return res
+	case <-s.done:
+		return result{err: ErrClosed}
+	}
+}
+
+// batcher groups requests that arrive within one batching window and
+// proposes each group as a single log entry. Groups are proposed
+// concurrently, so a slow entry does not hold up the next window.
+func (s *server) batcher() {
 	for {
-		// start a new round of paxos
-		s.p.StartPaxos(s.rid, r)
-		var new_r Request
-		// get log
-		for {
-			commit, log_r := s.p.GetLog(s.rid)
-			if commit {
-				new_r = log_r.(Request)
-				break
+		var batch []pending
+		select {
+		case p := <-s.incoming:
+			batch = append(batch, p)
+		case <-s.done:
+			return
+		}
+		deadline := s.clock.After(s.batchDelay)
+	collect:
+		for len(batch) < s.maxBatchSize {
+			if s.batchDelay > 0 {
+				select {
+				case p := <-s.incoming:
+					batch = append(batch, p)
+				case <-deadline:
+					break collect
+				}
 			} else {
-				time.Sleep(10 * time.Millisecond)
+				// no delay: take whatever is queued already
+				select {
+				case p := <-s.incoming:
+					batch = append(batch, p)
+				default:
+					break collect
+				}
+			}
+		}
+		go s.propose(batch)
+	}
+}
+
+// propose puts batch into free log entries until one of them decides it,
+// then hands every request its own result.
+func (s *server) propose(batch []pending) {
+	b := Batch{Server: s.self}
+	for _, p := range batch {
+		b.Requests = append(b.Requests, p.request)
+	}
+	s.ridLock.Lock()
+	s.batchID++
+	b.BatchID = s.batchID
+	s.ridLock.Unlock()
+	value, err := encodeBatch(s.codec, b)
+	if err != nil {
+		for _, p := range batch {
+			p.wait <- result{err: err}
+		}
+		return
+	}
+	for {
+		s.ridLock.Lock()
+		for s.nextRid >= s.rid+Alpha && !s.isClosed() {
+			// past the alpha window the membership may not be known yet
+			s.ridCond.Wait()
+		}
+		if s.isClosed() {
+			// submit has answered the requests already
+			s.ridLock.Unlock()
+			return
+		}
+		rid := s.nextRid
+		if rid < s.rid {
+			rid = s.rid
+		}
+		s.nextRid = rid + 1
+		wait := make(chan applied, 1)
+		s.waiters[rid] = wait
+		s.ridLock.Unlock()
+
+		s.p.StartPaxos(rid, value)
+		var a applied
+		select {
+		case a = <-wait:
+		case <-s.done:
+			return
+		}
+		// if get another batch, means this entry has been taken by other paxos node
+		// and we try again further down the log
+		if a.batch.Server == b.Server && a.batch.BatchID == b.BatchID {
+			for i, p := range batch {
+				p.wait <- a.results[i]
+			}
+			return
+		}
+	}
+}
+
+// applier applies decided entries strictly in log order, while later
+// entries may still be under way.
+func (s *server) applier() {
+	for {
+		stalled := s.clock.After(fillDelay)
+		select {
+		case decision, ok := <-s.decisions:
+			if !ok {
+				return
+			}
+			b, err := decodeBatch(decision.V_a)
+			if err != nil {
+				// skipping the entry would leave this server out of step
+				// for good: it needs a build that knows the format
+				log.Println("server", s.allHostPorts[s.self], "stops applying at", decision.Rid, ":", err)
+				return
+			}
+			s.apply(b)
+		case <-stalled:
+			// an entry nobody drives anymore (its proposer died) would
+			// block everything behind it, so fill it in with a no-op; this
+			// is also how a server that missed entries learns them
+			if s.hasLaterWaiters() || s.p.MaxID() > s.currentRid() {
+				if noop, err := encodeBatch(s.codec, Batch{Server: -1}); err == nil {
+					s.p.StartPaxos(s.currentRid(), noop)
+				}
 			}
+		case <-s.done:
+			return
 		}
-		// if get another r, means this round has been performed by other paxos node
-		// and it should catch up with other
+	}
+}
+
+func (s *server) apply(b Batch) {
+	s.ridLock.Lock()
+	defer s.ridLock.Unlock()
+
+	// recovery resumes after the rid of the last line, so every entry
+	// leaves one: a Noop if a witness, a duplicate or a shard that moved
+	// away skipped all of its requests
+	logged := false
+	logText := func(r Request) {
 		if s.needFile {
-			s.writeFile(os.O_APPEND|os.O_RDWR, s.genText(new_r))
+			s.writeFile(os.O_APPEND|os.O_RDWR, s.genText(r))
+			logged = true
 		}
+	}
+	results := make([]result, len(b.Requests))
+	for i, new_r := range b.Requests {
+		res := result{ok: true}
+		if new_r.Name == "AddNode" || new_r.Name == "RemoveNode" {
+			if m, changed := s.changeMembership(s.rid, new_r); changed {
+				// the quorum system is the same everywhere, so every
+				// server rejects the same changes
+				if err := s.p.Reconfigure(m.From, m.Members); err != nil {
+					res.ok = false
+				} else {
+					s.recordMembership(m)
+				}
+			}
+			if res.ok {
+				logText(new_r)
+			}
+			results[i] = res
+			continue
+		}
+		if new_r.Name == "Config" || new_r.Name == "Install" || new_r.Name == "Drop" {
+			// witnesses follow too, their group waits for them
+			s.applyShards(new_r)
+			logText(new_r)
+			results[i] = res
+			continue
+		}
+		if s.witness {
+			results[i] = res
+			continue
+		}
+		if err := s.shardErr(new_r.Key); err != nil {
+			// the shard moved before this entry
+			res.ok = false
+			res.err = err
+			results[i] = res
+			continue
+		}
+		if s.duplicate(new_r) {
+			results[i] = res
+			continue
+		}
+		logText(new_r)
+		s.storageLock.Lock()
 		if new_r.Name == "Put" {
-			s.storageLock.Lock()
 			s.storage[new_r.Key] = new_r.Value
-			s.storageLock.Unlock()
+		} else if new_r.Name == "Get" {
+			res.value, res.ok = s.storage[new_r.Key]
 		}
-		if new_r.AgentID == r.AgentID && new_r.RequestID == r.RequestID {
-			reply.AgentID = r.AgentID
-			reply.RequestID = r.RequestID
-			break
-		}
-		s.rid++
+		s.storageLock.Unlock()
+		results[i] = res
+		s.applied++
+	}
+	if !logged {
+		logText(Request{Name: "Noop"})
+	}
+
+	if wait, found := s.waiters[s.rid]; found {
+		wait <- applied{b, results}
+		delete(s.waiters, s.rid)
 	}
 	s.p.CommitFinished(s.rid)
 	s.rid++
+	s.ridCond.Broadcast()
+	if s.needFile && s.rid-s.snapshotRid >= s.snapshotEvery {
+		s.takeSnapshot()
+	}
+}
 
-	return nil
+func (s *server) currentRid() int {
+	s.ridLock.Lock()
+	defer s.ridLock.Unlock()
+	return s.rid
+}
 
+func (s *server) hasLaterWaiters() bool {
+	s.ridLock.Lock()
+	defer s.ridLock.Unlock()
+	return s.nextRid > s.rid+1
+}
+
+func (s *server) isClosed() bool {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.closed
 }
 
+// keys are escaped in the text log so they never hold its separator; a
+// value sits between the key and the fixed fields at the end, so it may.
+var (
+	keyEscaper   = strings.NewReplacer("%", "%25", ":", "%3A")
+	keyUnescaper = strings.NewReplacer("%3A", ":", "%25", "%")
+)
+
 func (s *server) genText(new_r Request) string {
-	var text = new_r.Name + "::" + new_r.Key + "::" + new_r.Value + "::" + strconv.Itoa(int(new_r.RequestID)) + "::" + strconv.Itoa(new_r.AgentID) + "::" + strconv.Itoa(s.rid) + "\n"
+	var text = new_r.Name + "::" + keyEscaper.Replace(new_r.Key) + "::" + new_r.Value + "::" + strconv.Itoa(int(new_r.RequestID)) + "::" + strconv.Itoa(new_r.AgentID) + "::" + strconv.Itoa(s.rid) + "\n"
 	return text
 }
 func (s *server) writeFile(flag int, text string) {
+	defer sim.Busy(s.clock)()
 	f, _ := os.OpenFile(s.fileName, flag, 0666)
 	defer f.Close()
 	io.WriteString(f, text)
@@ -211,24 +620,81 @@ func (s *server) recovery() {
 	}
 	for _, line := range strings.Split(string(fileBytes), "\n") {
 		e := strings.Split(string(line), "::")
+		if len(e) < 6 {
+			continue
+		}
+		// read the fixed fields from the end, the value may hold "::"
+		rid, err := strconv.Atoi(e[len(e)-1])
+		if err != nil || rid < s.snapshotRid {
+			// covered by the snapshot already
+			continue
+		}
+		key := keyUnescaper.Replace(e[1])
+		value := strings.Join(e[2:len(e)-3], "::")
 		if e[0] == "Put" {
-			s.storage[e[1]] = e[2]
-			s.rid++
-		}else if e[0] == "Get"{
-			s.rid++
+			s.storage[key] = value
+			agentID, _ := strconv.Atoi(e[len(e)-2])
+			requestID, _ := strconv.ParseInt(e[len(e)-3], 10, 64)
+			s.duplicate(Request{Name: "Put", AgentID: agentID, RequestID: requestID})
+		}
+		if e[0] == "Config" || e[0] == "Install" || e[0] == "Drop" {
+			s.applyShards(Request{Name: e[0], Value: value})
+		} else if e[0] == "AddNode" || e[0] == "RemoveNode" {
+			// start() hands the memberships to paxos again
+			if m, changed := s.changeMembership(rid, Request{Name: e[0], Key: key}); changed {
+				s.recordMembership(m)
+			}
+		} else if e[0] != "Noop" {
+			s.applied++
 		}
+		// one log entry may carry several requests
+		s.rid = rid + 1
 	}
 
 }
 
 func (s *server) Close() {
 	s.listener.Close()
+	if s.metrics != nil {
+		s.metrics.Close()
+	}
 	s.p.Close()
 	s.closeLock.Lock()
+	if !s.closed {
+		close(s.done)
+	}
 	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
 	s.closeLock.Unlock()
+	// wake whoever waits for an entry that will never be applied now
+	s.ridLock.Lock()
+	s.ridCond.Broadcast()
+	s.ridLock.Unlock()
+	if s.ownTransport {
+		s.transport.Close()
+	} else {
+		// nobody else would release calls stuck in a blackhole
+		s.faults.Heal()
+	}
+}
+
+// SetLink changes how calls from this server to args.Peer misbehave, see
+// transport.Link; the zero Link heals it again, and with an empty Peer
+// every link of the server.
+func (s *server) SetLink(args *LinkArgs, reply *LinkReply) error {
+	if args.Peer == "" {
+		s.faults.Heal()
+	} else {
+		s.faults.SetLink(args.Peer, args.Link)
+	}
+	reply.OK = true
+	return nil
 }
 
 func (s *server) StorageSize() int {
-	return s.rid
+	s.ridLock.Lock()
+	defer s.ridLock.Unlock()
+	return s.applied
 }
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"transport"
+)
+
+// JoinServer starts a server at address that joins the cluster contact
+// belongs to. The change goes through the log of the cluster, then the
+// new server starts from a snapshot of contact and learns the rest of
+// the log like any other server that fell behind.
+func JoinServer(address string, contact string, config *Config) (Server, error) {
+	joinConfig := *config
+	ownTransport := false
+	if joinConfig.Transport == nil {
+		joinConfig.Transport = transport.Default(address)
+		ownTransport = true
+	}
+	t := joinConfig.Transport
+	fail := func(err error) (Server, error) {
+		if ownTransport {
+			t.Close()
+		}
+		return nil, err
+	}
+
+	reply := &MembershipReply{}
+	if err := t.Call(contact, "Server.AddNode", &MembershipArgs{address}, reply); err != nil {
+		return fail(err)
+	}
+	if !reply.OK {
+		return fail(errors.New("the cluster did not take " + address + " in"))
+	}
+	snapshot := &SnapshotReply{}
+	if err := t.Call(contact, "Server.Snapshot", &SnapshotArgs{}, snapshot); err != nil {
+		return fail(err)
+	}
+	self := -1
+	for i, hostPort := range snapshot.AllHostPorts {
+		if hostPort == address {
+			self = i
+		}
+	}
+	if self < 0 {
+		return fail(errors.New("snapshot does not know " + address))
+	}
+
+	s := newServer(snapshot.AllHostPorts, self, &joinConfig)
+	s.ownTransport = ownTransport
+	s.memberships = snapshot.Memberships
+	if snapshot.Storage != nil {
+		s.storage = snapshot.Storage
+	}
+	s.rid = snapshot.Rid
+	s.nextRid = snapshot.Rid
+	s.applied = snapshot.Applied
+	s.loadShards(&snapshot.Snapshot)
+	if s.needFile {
+		// whatever an earlier server at this address left behind is stale
+		if err := s.writeSnapshot(&snapshot.Snapshot); err != nil {
+			return fail(err)
+		}
+		s.snapshotRid = snapshot.Rid
+		s.writeFile(os.O_CREATE|os.O_TRUNC|os.O_RDWR, "Server: "+address+"\n")
+		os.Remove(s.logDir + "/paxos_" + address)
+	}
+	if err := s.start(&joinConfig); err != nil {
+		return fail(err)
+	}
+	return s, nil
+}
+
+// AddNode makes the server at args.Address a member from Alpha log
+// entries after the change is decided on.
+func (s *server) AddNode(args *MembershipArgs, reply *MembershipReply) error {
+	result := s.submit(Request{Name: "AddNode", Key: args.Address})
+	reply.OK = result.ok
+	return result.err
+}
+
+// RemoveNode takes the server at args.Address out of the quorum from Alpha
+// log entries after the change is decided on. It can be closed from then on.
+func (s *server) RemoveNode(args *MembershipArgs, reply *MembershipReply) error {
+	result := s.submit(Request{Name: "RemoveNode", Key: args.Address})
+	reply.OK = result.ok
+	return result.err
+}
+
+func (s *server) Snapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+	s.ridLock.Lock()
+	defer s.ridLock.Unlock()
+	// the reply is encoded after the lock is released, so it gets a copy
+	reply.Snapshot = *s.snapshot()
+	return nil
+}
+
+// changeMembership returns the membership that r, applied at entry rid,
+// leads to; the caller holds ridLock.
+func (s *server) changeMembership(rid int, r Request) (Membership, bool) {
+	current := s.memberships[len(s.memberships)-1].Members
+	if (r.Name == "AddNode") == contains(current, r.Key) {
+		// adding a member or removing a stranger changes nothing
+		return Membership{}, false
+	}
+	if r.Name == "AddNode" && contains(s.learners, r.Key) {
+		// learners get every decision as it is, they never vote
+		return Membership{}, false
+	}
+	members := without(current, []string{r.Key})
+	if r.Name == "AddNode" {
+		members = append(members, r.Key)
+	}
+	if len(members) == 0 {
+		return Membership{}, false
+	}
+	return Membership{rid + Alpha, members}, true
+}
+
+func (s *server) recordMembership(m Membership) {
+	for _, member := range m.Members {
+		if !contains(s.allHostPorts, member) {
+			s.allHostPorts = append(s.allHostPorts, member)
+		}
+	}
+	s.memberships = append(s.memberships, m)
+}
+
+// without returns hostPorts minus the ones in drop, in a new slice.
+func without(hostPorts []string, drop []string) []string {
+	kept := []string{}
+	for _, h := range hostPorts {
+		if !contains(drop, h) {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+func contains(hostPorts []string, hostPort string) bool {
+	for _, h := range hostPorts {
+		if h == hostPort {
+			return true
+		}
+	}
+	return false
+}
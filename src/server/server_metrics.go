@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"paxos"
+	"sort"
+	"strings"
+)
+
+// serveMetrics answers GET /metrics on address with the counters of this
+// server and its paxos node, in the Prometheus text format.
+func (s *server) serveMetrics(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.metrics = l
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	go http.Serve(l, mux)
+	return nil
+}
+
+func (s *server) writeMetrics(w io.Writer) {
+	s.ridLock.Lock()
+	rid, applied := s.rid, s.applied
+	s.ridLock.Unlock()
+	gauge(w, "server_log_applied", "Log entries applied to the key-value state.", int64(rid))
+	counter(w, "server_requests_applied_total", "Client requests applied to the key-value state.", int64(applied))
+	WriteStats(w, s.p.Stats())
+}
+
+// WriteStats writes stats in the Prometheus text format.
+func WriteStats(w io.Writer, stats paxos.Stats) {
+	counter(w, "paxos_proposals_started_total", "Proposals this node started.", stats.ProposalsStarted)
+	counter(w, "paxos_proposals_decided_total", "Proposals that ended with their instance decided.", stats.ProposalsDecided)
+	counter(w, "paxos_prepare_rejections_total", "Prepare replies that refused the ballot of this node.", stats.PrepareRejections)
+	counter(w, "paxos_accept_rejections_total", "Accept replies that refused the ballot of this node.", stats.AcceptRejections)
+	counter(w, "paxos_instances_collected_total", "Instances dropped below MinID.", stats.InstancesCollected)
+	histogram(w, "paxos_rounds_per_decision", "Prepare or Accept rounds a decided proposal took.", stats.Rounds)
+	histogram(w, "paxos_decision_latency_seconds", "Time from the start of a proposal to its decision.", stats.Latency)
+
+	keys := []paxos.RPCKey{}
+	for key := range stats.RPCs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Peer != keys[j].Peer {
+			return keys[i].Peer < keys[j].Peer
+		}
+		return keys[i].Phase < keys[j].Phase
+	})
+	header(w, "paxos_rpcs_sent_total", "RPCs sent to a peer.", "counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "paxos_rpcs_sent_total{peer=%v,phase=%v} %d\n", label(key.Peer), label(key.Phase), stats.RPCs[key].Sent)
+	}
+	header(w, "paxos_rpcs_failed_total", "RPCs that got no reply: lost, refused or timed out.", "counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "paxos_rpcs_failed_total{peer=%v,phase=%v} %d\n", label(key.Peer), label(key.Phase), stats.RPCs[key].Failed)
+	}
+}
+
+func header(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func counter(w io.Writer, name string, help string, value int64) {
+	header(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func gauge(w io.Writer, name string, help string, value int64) {
+	header(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// histogram writes h the way Prometheus wants it: cumulative buckets.
+func histogram(w io.Writer, name string, help string, h paxos.Histogram) {
+	header(w, name, help, "histogram")
+	total := int64(0)
+	for i, bound := range h.Bounds {
+		total += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, total)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.Sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
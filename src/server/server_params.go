@@ -1,5 +1,52 @@
 package server
 
+import "paxos"
+import "shard"
+import "sim"
+import "time"
+import "transport"
+
+// Config holds the optional settings of a server.
+type Config struct {
+	IsDebug   bool
+	Seed      int64     // seeds IsDebug, 0 means a fresh seed
+	Clock     sim.Clock // nil means sim.Wall
+	NeedFile  bool
+	Transport transport.Transport // nil picks one from the address of this server
+	Quorum    paxos.QuorumSystem  // nil means a majority of the members
+	Codec     Codec               // how this server writes log entries, nil means GobCodec
+
+	// same on every server: learners keep a copy and serve reads from it
+	// without voting, witnesses vote but keep no key-value state
+	Learners  []string
+	Witnesses []string
+
+	MaxBatchSize int           // requests per log entry, 0 means DefaultMaxBatchSize
+	BatchDelay   time.Duration // how long a batch waits for more requests, 0 means not at all
+
+	// same on every server: a leader holding a lease answers Gets from its
+	// own copy; safe as long as no two clocks run further apart than Drift
+	Lease time.Duration // 0 means every Get goes through the log
+	Drift float64       // 0 means paxos.DefaultDrift
+
+	// how long a proposer that lost a round waits, doubled on every
+	// further loss up to MaxBackoff
+	Backoff    time.Duration // 0 means paxos.DefaultBackoff
+	MaxBackoff time.Duration // 0 means paxos.DefaultMaxBackoff
+
+	MetricsAddress string       // host:port serving /metrics for Prometheus, "" means no endpoint
+	Tracer         paxos.Tracer // gets every protocol event of the paxos node, nil means none
+
+	LogDir        string // where NeedFile keeps its files, "" means ../logs
+	SnapshotEvery int    // log entries between snapshots, 0 means DefaultSnapshotEvery
+
+	// the replica group this server belongs to and the shard controller
+	// that assigns groups their shards; no controllers means the server
+	// keeps every key
+	GID         int
+	Controllers []string
+}
+
 type Request struct {
 	AgentID   int
 	RequestID int64
@@ -8,6 +55,21 @@ type Request struct {
 	Value     string
 }
 
+// Batch is the value of one log entry: requests one server collected in a
+// batching window. Server and BatchID tell the proposer it won the entry.
+type Batch struct {
+	Server   int
+	BatchID  int64
+	Requests []Request
+}
+
+// Membership lists the servers whose majority decides every log entry
+// >= From, up to the From of the next one.
+type Membership struct {
+	From    int
+	Members []string
+}
+
 type GetArgs struct {
 	AgentID   int
 	RequestID int64
@@ -19,7 +81,7 @@ type GetReply struct {
 	RequestID int64
 	Value     string
 	OK        bool
-	Error     error 
+	Error     error
 }
 
 type PutArgs struct {
@@ -35,3 +97,60 @@ type PutReply struct {
 	OK        bool
 	Error     error
 }
+
+type MembershipArgs struct {
+	Address string
+}
+
+type MembershipReply struct {
+	OK bool
+}
+
+type LinkArgs struct {
+	Peer string
+	Link transport.Link
+}
+
+type LinkReply struct {
+	OK bool
+}
+
+type SnapshotArgs struct {
+}
+
+// Snapshot is the state of a server after applying every entry below Rid.
+// It is what a joining server starts from, and what recovery starts from
+// before it replays the tail of the log.
+type Snapshot struct {
+	AllHostPorts []string
+	Memberships  []Membership
+	Storage      map[string]string
+	Rid          int // first log entry not covered by Storage
+	Applied      int
+	Shards       shard.Config
+	Seen         map[int]int64 // last Put RequestID of every agent, sharded only
+	Incoming     map[int]bool  // shards still to be installed
+	Outgoing     []Migration   // shards frozen here until their group has them
+}
+
+type SnapshotReply struct {
+	Snapshot
+}
+
+// Migration is a shard leaving a group in config Num, with the keys it
+// held and the requests it has seen, on its way to Servers.
+type Migration struct {
+	Num     int
+	Shard   int
+	Servers []string
+	Storage map[string]string
+	Seen    map[int]int64
+}
+
+type InstallArgs struct {
+	Migration
+}
+
+type InstallReply struct {
+	OK bool
+}
@@ -3,6 +3,11 @@ package server
 type RemoteStorageServer interface {
 	Put(*PutArgs, *PutReply) error
 	Get(*GetArgs, *GetReply) error
+	AddNode(*MembershipArgs, *MembershipReply) error
+	RemoveNode(*MembershipArgs, *MembershipReply) error
+	Snapshot(*SnapshotArgs, *SnapshotReply) error
+	InstallShard(*InstallArgs, *InstallReply) error
+	SetLink(*LinkArgs, *LinkReply) error
 }
 
 type ServerRPC struct {
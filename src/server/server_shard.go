@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"shard"
+	"time"
+)
+
+// ErrWrongGroup is what a server of a sharded cluster answers for a key
+// its replica group does not serve; the client should ask the controller
+// again and go to the right group.
+var ErrWrongGroup = errors.New("wrong group")
+
+// ErrMigrating is what both groups answer for a key whose shard is on its
+// way from one to the other; the client should try again shortly.
+var ErrMigrating = errors.New("shard is migrating")
+
+// how often a sharded server asks the controller for the next config
+const configPoll = 100 * time.Millisecond
+
+// shardErr tells whether this server answers for key under the config it
+// has applied; the caller holds ridLock.
+func (s *server) shardErr(key string) error {
+	if s.clerk == nil {
+		return nil
+	}
+	sh := shard.KeyShard(key)
+	if s.shards.Shards[sh] == s.gid {
+		if s.arriving[sh] {
+			return ErrMigrating
+		}
+		return nil
+	}
+	for _, m := range s.leaving {
+		if m.Shard == sh {
+			return ErrMigrating
+		}
+	}
+	return ErrWrongGroup
+}
+
+func (s *server) keyErr(key string) error {
+	s.ridLock.Lock()
+	defer s.ridLock.Unlock()
+	return s.shardErr(key)
+}
+
+// duplicate tells whether r is a Put the group applied already, and
+// remembers it otherwise; the caller holds ridLock. Clients of a sharded
+// cluster send one request at a time, with growing RequestIDs, so a
+// request may reach a group again after its shard moved there.
+func (s *server) duplicate(r Request) bool {
+	if s.clerk == nil || r.Name != "Put" {
+		return false
+	}
+	if last, found := s.seen[r.AgentID]; found && r.RequestID <= last {
+		return true
+	}
+	s.seen[r.AgentID] = r.RequestID
+	return false
+}
+
+// watchShards hands the shards frozen here to their new groups, and puts
+// every new config of the controller into the log, one at a time and in
+// order, so all servers of the group switch to it at the same entry. It
+// moves on to the next config only once every shard of the current one
+// arrived.
+func (s *server) watchShards() {
+	for {
+		select {
+		case <-s.clock.After(configPoll):
+		case <-s.done:
+			return
+		}
+		if !s.witness {
+			// a witness holds none of the keys it would hand over
+			s.sendShards()
+		}
+		s.ridLock.Lock()
+		num := s.shards.Num
+		waiting := len(s.arriving) > 0
+		s.ridLock.Unlock()
+		if waiting {
+			continue
+		}
+		next, err := s.clerk.Query(num + 1)
+		if err != nil || next.Num != num+1 {
+			continue
+		}
+		value, err := json.Marshal(next)
+		if err != nil {
+			continue
+		}
+		if s.submit(Request{Name: "Config", Value: string(value)}).err == ErrClosed {
+			return
+		}
+	}
+}
+
+// sendShards tries to install every shard leaving in its new group and drops
+// the ones that got there.
+func (s *server) sendShards() {
+	s.ridLock.Lock()
+	leaving := append([]Migration{}, s.leaving...)
+	s.ridLock.Unlock()
+	for _, m := range leaving {
+		for _, address := range m.Servers {
+			reply := &InstallReply{}
+			if err := s.transport.Call(address, "Server.InstallShard", &InstallArgs{m}, reply); err != nil || !reply.OK {
+				continue
+			}
+			value, err := json.Marshal(Migration{Num: m.Num, Shard: m.Shard})
+			if err != nil {
+				break
+			}
+			s.submit(Request{Name: "Drop", Value: string(value)})
+			break
+		}
+	}
+}
+
+// InstallShard takes in a shard another group froze in config args.Num.
+// The shard goes through the log, so every server of the group installs
+// it at the same entry.
+func (s *server) InstallShard(args *InstallArgs, reply *InstallReply) error {
+	s.ridLock.Lock()
+	num := s.shards.Num
+	waiting := s.arriving[args.Shard]
+	s.ridLock.Unlock()
+	if num < args.Num {
+		return ErrMigrating
+	}
+	if num > args.Num || !waiting {
+		// a group moves on only once all of its shards arrived
+		reply.OK = true
+		return nil
+	}
+	value, err := json.Marshal(args.Migration)
+	if err != nil {
+		return err
+	}
+	if result := s.submit(Request{Name: "Install", Value: string(value)}); result.err != nil {
+		return result.err
+	}
+	reply.OK = true
+	return nil
+}
+
+// applyShards applies a Config, Install or Drop entry; the caller holds
+// ridLock.
+func (s *server) applyShards(r Request) {
+	switch r.Name {
+	case "Config":
+		var config shard.Config
+		if err := json.Unmarshal([]byte(r.Value), &config); err == nil {
+			s.applyConfig(config)
+		}
+	case "Install":
+		var m Migration
+		if err := json.Unmarshal([]byte(r.Value), &m); err == nil {
+			s.install(m)
+		}
+	case "Drop":
+		var m Migration
+		if err := json.Unmarshal([]byte(r.Value), &m); err == nil {
+			for i, o := range s.leaving {
+				if o.Num == m.Num && o.Shard == m.Shard {
+					s.leaving = append(s.leaving[:i:i], s.leaving[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
+
+// applyConfig switches to config if it is the next one. Shards the group
+// loses are frozen with their keys until their new group has them, shards
+// it gains from another group wait for them.
+func (s *server) applyConfig(config shard.Config) {
+	if config.Num != s.shards.Num+1 {
+		return
+	}
+	s.storageLock.Lock()
+	defer s.storageLock.Unlock()
+	for sh := 0; sh < shard.NShards; sh++ {
+		from, to := s.shards.Shards[sh], config.Shards[sh]
+		if from == s.gid && to != s.gid {
+			m := Migration{config.Num, sh, config.Groups[to], map[string]string{}, map[int]int64{}}
+			for key, value := range s.storage {
+				if shard.KeyShard(key) == sh {
+					m.Storage[key] = value
+					delete(s.storage, key)
+				}
+			}
+			for agent, last := range s.seen {
+				m.Seen[agent] = last
+			}
+			// group 0 has no servers, so such a shard stays frozen here
+			s.leaving = append(s.leaving, m)
+		} else if to == s.gid && from != s.gid && from != 0 {
+			s.arriving[sh] = true
+		}
+	}
+	s.shards = config
+}
+
+// install takes the keys of m in if this group still waits for them.
+func (s *server) install(m Migration) {
+	if m.Num != s.shards.Num || !s.arriving[m.Shard] {
+		return
+	}
+	s.storageLock.Lock()
+	for key, value := range m.Storage {
+		s.storage[key] = value
+	}
+	s.storageLock.Unlock()
+	for agent, last := range m.Seen {
+		if last > s.seen[agent] {
+			s.seen[agent] = last
+		}
+	}
+	delete(s.arriving, m.Shard)
+}
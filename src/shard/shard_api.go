@@ -0,0 +1,12 @@
+package shard
+
+// Controller assigns shards to replica groups. It runs as a set of
+// replicas that agree on every change through Paxos, so any replica
+// answers for all of them.
+type Controller interface {
+	Join(args *JoinArgs, reply *JoinReply) error
+	Leave(args *LeaveArgs, reply *LeaveReply) error
+	Move(args *MoveArgs, reply *MoveReply) error
+	Query(args *QueryArgs, reply *QueryReply) error
+	Close()
+}
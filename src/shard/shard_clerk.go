@@ -0,0 +1,70 @@
+package shard
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"transport"
+)
+
+var errNoController = errors.New("no controller replica answered")
+
+// Clerk talks to the controller for clients and servers, and keeps the
+// last config it saw for routing keys.
+type Clerk struct {
+	controllers []string
+	transport   transport.Transport
+	lock        sync.Mutex
+	config      Config
+}
+
+func NewClerk(controllers []string, t transport.Transport) *Clerk {
+	return &Clerk{controllers: controllers, transport: t}
+}
+
+// call tries every controller replica in turn, until one answers.
+func (ck *Clerk) call(serviceMethod string, args interface{}, reply interface{}) error {
+	err := errNoController
+	for _, address := range ck.controllers {
+		err = ck.transport.Call(address, serviceMethod, args, reply)
+		if _, refused := err.(rpc.ServerError); err == nil || refused {
+			return err
+		}
+	}
+	return err
+}
+
+// Query returns config num, or the latest one for -1.
+func (ck *Clerk) Query(num int) (Config, error) {
+	reply := &QueryReply{}
+	if err := ck.call("Controller.Query", &QueryArgs{num}, reply); err != nil {
+		return Config{}, err
+	}
+	ck.lock.Lock()
+	defer ck.lock.Unlock()
+	if reply.Config.Num > ck.config.Num || ck.config.Groups == nil {
+		ck.config = reply.Config
+	}
+	return reply.Config, nil
+}
+
+func (ck *Clerk) Join(gid int, servers []string) error {
+	return ck.call("Controller.Join", &JoinArgs{gid, servers}, &JoinReply{})
+}
+
+func (ck *Clerk) Leave(gid int) error {
+	return ck.call("Controller.Leave", &LeaveArgs{gid}, &LeaveReply{})
+}
+
+func (ck *Clerk) Move(shard int, gid int) error {
+	return ck.call("Controller.Move", &MoveArgs{shard, gid}, &MoveReply{})
+}
+
+// Servers returns the group serving key and its servers, as of the last
+// config this clerk saw; after a wrong group error, Query(-1) first.
+func (ck *Clerk) Servers(key string) (int, []string) {
+	ck.lock.Lock()
+	defer ck.lock.Unlock()
+	gid := ck.config.Shards[KeyShard(key)]
+	return gid, ck.config.Groups[gid]
+}
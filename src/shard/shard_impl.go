@@ -0,0 +1,252 @@
+package shard
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"paxos"
+	"sort"
+	"sync"
+	"time"
+	"transport"
+)
+
+// Once a shard belongs to a group it always belongs to one: group 0 has
+// no servers to hand its keys to.
+var (
+	errNoGroup   = errors.New("no such group")
+	errLastGroup = errors.New("the last group cannot leave")
+)
+
+type controller struct {
+	lock         sync.Mutex // one submitted op at a time
+	self         int
+	p            paxos.Paxos
+	configs      []Config
+	next         int // next log entry to apply
+	random       *rand.Rand
+	ctx          context.Context
+	cancel       context.CancelFunc
+	listener     net.Listener
+	connLock     sync.Mutex
+	conns        map[net.Conn]bool
+	closed       bool
+	transport    transport.Transport
+	ownTransport bool
+}
+
+// NewController starts replica self of the controller made of peers. A
+// nil transport picks one from the address of this replica.
+func NewController(peers []string, self int, t transport.Transport) (Controller, error) {
+	c := &controller{
+		self:      self,
+		configs:   []Config{{Groups: map[int][]string{}}},
+		random:    rand.New(rand.NewSource(time.Now().UnixNano() + int64(self))),
+		conns:     make(map[net.Conn]bool),
+		transport: t,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if c.transport == nil {
+		c.transport = transport.Default(peers[self])
+		c.ownTransport = true
+	}
+	rpcs := rpc.NewServer()
+	p := paxos.NewPaxosWithConfig(peers, self, rpcs, &paxos.Config{Transport: c.transport})
+	if p == nil {
+		return nil, errors.New("could not start paxos")
+	}
+	c.p = p
+	if err := rpcs.RegisterName("Controller", Wrap(c)); err != nil {
+		return nil, err
+	}
+	l, err := c.transport.Listen(peers[self])
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	c.listener = l
+	go func() {
+		for {
+			conn, err := c.listener.Accept()
+			c.connLock.Lock()
+			if err == nil && !c.closed {
+				c.conns[conn] = true
+				go rpcs.ServeConn(conn)
+			} else if err == nil {
+				conn.Close()
+			} else if c.closed {
+				c.connLock.Unlock()
+				return
+			}
+			c.connLock.Unlock()
+		}
+	}()
+	return c, nil
+}
+
+func (c *controller) Join(args *JoinArgs, reply *JoinReply) error {
+	_, err := c.submit(Op{Name: "Join", GID: args.GID, Servers: args.Servers})
+	reply.OK = err == nil
+	return err
+}
+
+func (c *controller) Leave(args *LeaveArgs, reply *LeaveReply) error {
+	_, err := c.submit(Op{Name: "Leave", GID: args.GID})
+	reply.OK = err == nil
+	return err
+}
+
+func (c *controller) Move(args *MoveArgs, reply *MoveReply) error {
+	if args.Shard < 0 || args.Shard >= NShards {
+		return errors.New("no such shard")
+	}
+	_, err := c.submit(Op{Name: "Move", Shard: args.Shard, GID: args.GID})
+	reply.OK = err == nil
+	return err
+}
+
+// Query goes through the log as well, so it sees every change that
+// finished before it was asked.
+func (c *controller) Query(args *QueryArgs, reply *QueryReply) error {
+	config, err := c.submit(Op{Name: "Query", Num: args.Num})
+	reply.Config = config
+	return err
+}
+
+func (c *controller) Close() {
+	c.cancel()
+	c.listener.Close()
+	c.connLock.Lock()
+	c.closed = true
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.connLock.Unlock()
+	c.p.Close()
+	if c.ownTransport {
+		c.transport.Close()
+	}
+}
+
+// submit appends op to the log and applies the log up to it. It returns
+// the config op asked for, or the latest one.
+func (c *controller) submit(op Op) (Config, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	op.ID = c.random.Int63()
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(op); err != nil {
+		return Config{}, err
+	}
+	for {
+		value, err := c.p.Decide(c.ctx, c.next, buffer.Bytes())
+		if err != nil {
+			return Config{}, err
+		}
+		var decided Op
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&decided); err != nil {
+			return Config{}, err
+		}
+		err = c.apply(decided)
+		c.p.CommitFinished(c.next)
+		c.next++
+		if decided.ID == op.ID {
+			if err != nil {
+				return Config{}, err
+			}
+			if op.Name == "Query" && op.Num >= 0 && op.Num < len(c.configs) {
+				return c.configs[op.Num], nil
+			}
+			return c.configs[len(c.configs)-1], nil
+		}
+	}
+}
+
+// apply makes the config op asks for, unless it would leave a shard with
+// no group.
+func (c *controller) apply(op Op) error {
+	if op.Name == "Query" {
+		return nil
+	}
+	last := c.configs[len(c.configs)-1]
+	_, found := last.Groups[op.GID]
+	switch {
+	case op.Name == "Leave" && found && len(last.Groups) == 1:
+		return errLastGroup
+	case op.Name == "Move" && !found:
+		return errNoGroup
+	}
+	config := Config{Num: last.Num + 1, Shards: last.Shards, Groups: map[int][]string{}}
+	for gid, servers := range last.Groups {
+		config.Groups[gid] = servers
+	}
+	switch op.Name {
+	case "Join":
+		config.Groups[op.GID] = append([]string{}, op.Servers...)
+		rebalance(&config)
+	case "Leave":
+		delete(config.Groups, op.GID)
+		rebalance(&config)
+	case "Move":
+		config.Shards[op.Shard] = op.GID
+	}
+	c.configs = append(c.configs, config)
+	return nil
+}
+
+// rebalance spreads the shards evenly over the groups of config, moving
+// as few as it can. Every replica runs it on the same config, so it may
+// not depend on map order.
+func rebalance(config *Config) {
+	gids := []int{}
+	for gid := range config.Groups {
+		gids = append(gids, gid)
+	}
+	if len(gids) == 0 {
+		config.Shards = [NShards]int{}
+		return
+	}
+	count := map[int]int{}
+	for shard, gid := range config.Shards {
+		if _, found := config.Groups[gid]; found {
+			count[gid]++
+		} else {
+			config.Shards[shard] = 0
+		}
+	}
+	// groups that hold the most keep the extra shards
+	sort.Slice(gids, func(i, j int) bool {
+		if count[gids[i]] != count[gids[j]] {
+			return count[gids[i]] > count[gids[j]]
+		}
+		return gids[i] < gids[j]
+	})
+	target := map[int]int{}
+	for i, gid := range gids {
+		target[gid] = NShards / len(gids)
+		if i < NShards%len(gids) {
+			target[gid]++
+		}
+	}
+	for shard, gid := range config.Shards {
+		if gid != 0 && count[gid] > target[gid] {
+			count[gid]--
+			config.Shards[shard] = 0
+		}
+	}
+	for _, gid := range gids {
+		for shard := range config.Shards {
+			if count[gid] == target[gid] {
+				break
+			}
+			if config.Shards[shard] == 0 {
+				config.Shards[shard] = gid
+				count[gid]++
+			}
+		}
+	}
+}
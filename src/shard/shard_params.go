@@ -0,0 +1,67 @@
+package shard
+
+import "hash/fnv"
+
+// NShards is how many shards the key space is cut into. It is part of
+// the data layout: every server and client has to agree on it.
+const NShards = 10
+
+// Config says which replica group serves each shard. Group 0 serves
+// nothing: a shard assigned to it is unavailable. Num counts the configs,
+// the first one, with no groups, is 0.
+type Config struct {
+	Num    int
+	Shards [NShards]int
+	Groups map[int][]string // replica group id -> server addresses
+}
+
+// KeyShard is the shard key belongs to.
+func KeyShard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % NShards)
+}
+
+type JoinArgs struct {
+	GID     int
+	Servers []string
+}
+
+type JoinReply struct {
+	OK bool
+}
+
+type LeaveArgs struct {
+	GID int
+}
+
+type LeaveReply struct {
+	OK bool
+}
+
+type MoveArgs struct {
+	Shard int
+	GID   int
+}
+
+type MoveReply struct {
+	OK bool
+}
+
+type QueryArgs struct {
+	Num int // -1 or too high for the latest config
+}
+
+type QueryReply struct {
+	Config Config
+}
+
+// Op is one entry of the controller log.
+type Op struct {
+	ID      int64 // tells the submitter its own entry from another
+	Name    string
+	GID     int
+	Servers []string
+	Shard   int
+	Num     int
+}
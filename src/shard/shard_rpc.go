@@ -0,0 +1,16 @@
+package shard
+
+type RemoteController interface {
+	Join(*JoinArgs, *JoinReply) error
+	Leave(*LeaveArgs, *LeaveReply) error
+	Move(*MoveArgs, *MoveReply) error
+	Query(*QueryArgs, *QueryReply) error
+}
+
+type ControllerRPC struct {
+	RemoteController
+}
+
+func Wrap(c RemoteController) RemoteController {
+	return &ControllerRPC{c}
+}
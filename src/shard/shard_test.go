@@ -0,0 +1,123 @@
+package shard
+
+import "testing"
+import "transport"
+import "fmt"
+import "strconv"
+
+func check(t *testing.T, config Config, gids ...int) {
+	if len(config.Groups) != len(gids) {
+		t.Fatalf("config %v has groups %v, expected %v", config.Num, config.Groups, gids)
+	}
+	count := map[int]int{}
+	for _, gid := range config.Shards {
+		if _, found := config.Groups[gid]; !found {
+			t.Fatalf("config %v assigns a shard to unknown group %v", config.Num, gid)
+		}
+		count[gid]++
+	}
+	for _, gid := range gids {
+		if count[gid] < NShards/len(gids) || count[gid] > NShards/len(gids)+1 {
+			t.Fatalf("config %v is unbalanced: %v", config.Num, config.Shards)
+		}
+	}
+}
+
+func moved(a Config, b Config) int {
+	n := 0
+	for shard := range a.Shards {
+		if a.Shards[shard] != b.Shards[shard] {
+			n++
+		}
+	}
+	return n
+}
+
+func TestController(t *testing.T) {
+	fmt.Printf("Test: Replicated shard controller ...\n")
+
+	const nctrl = 3
+	network := transport.NewMemNetwork()
+	peers := make([]string, nctrl)
+	for i := range peers {
+		peers[i] = "ctrl-" + strconv.Itoa(i)
+	}
+	ctrls := make([]Controller, nctrl)
+	for i := range peers {
+		var err error
+		if ctrls[i], err = NewController(peers, i, network.Transport()); err != nil {
+			t.Fatalf("NewController: %v", err)
+		}
+	}
+	defer func() {
+		for _, c := range ctrls {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}()
+	ck := NewClerk(peers, network.Transport())
+
+	if config, err := ck.Query(-1); err != nil || config.Num != 0 || config.Shards != [NShards]int{} {
+		t.Fatalf("initial config %+v, %v", config, err)
+	}
+	ck.Join(1, []string{"a"})
+	ck.Join(2, []string{"b"})
+	c2, _ := ck.Query(-1)
+	check(t, c2, 1, 2)
+	ck.Join(3, []string{"c"})
+	c3, _ := ck.Query(-1)
+	check(t, c3, 1, 2, 3)
+	if n := moved(c2, c3); n > NShards/3+1 {
+		t.Fatalf("join of one group moved %v shards", n)
+	}
+
+	// every replica answers for all of them
+	for i := range peers {
+		reply := &QueryReply{}
+		if err := ctrls[i].Query(&QueryArgs{Num: 2}, reply); err != nil || reply.Config.Shards != c2.Shards {
+			t.Fatalf("replica %v: config 2 is %+v, %v", i, reply.Config, err)
+		}
+	}
+
+	ck.Leave(2)
+	c4, _ := ck.Query(-1)
+	check(t, c4, 1, 3)
+	for shard, gid := range c3.Shards {
+		if gid != 2 && c4.Shards[shard] != gid {
+			t.Fatalf("leave moved shard %v from group %v", shard, gid)
+		}
+	}
+
+	// a majority of replicas is enough
+	ctrls[0].Close()
+	ctrls[0] = nil
+	if err := ck.Move(0, 3); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	c5, err := ck.Query(-1)
+	if err != nil || c5.Num != 5 || c5.Shards[0] != 3 {
+		t.Fatalf("after Move: %+v, %v", c5, err)
+	}
+	if gid, servers := ck.Servers("key"); gid != c5.Shards[KeyShard("key")] || len(servers) != 1 {
+		t.Fatalf("key routed to %v %v", gid, servers)
+	}
+
+	// a shard never goes back to group 0
+	if err := ck.Move(1, 7); err == nil {
+		t.Fatalf("Move to an unknown group succeeded")
+	}
+	if err := ck.Move(1, 0); err == nil {
+		t.Fatalf("Move to group 0 succeeded")
+	}
+	ck.Leave(1)
+	if err := ck.Leave(3); err == nil {
+		t.Fatalf("the last group left")
+	}
+	c6, err := ck.Query(-1)
+	if err != nil || c6.Num != 6 {
+		t.Fatalf("refused changes made configs: %+v, %v", c6, err)
+	}
+	check(t, c6, 3)
+	fmt.Printf("  ... Passed\n")
+}
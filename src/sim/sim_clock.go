@@ -0,0 +1,153 @@
+package sim
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is where a node gets its time from. Real nodes use Wall; nodes
+// under a Simulator share its Virtual clock, which only moves when the
+// scheduler moves it.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+type wallClock struct{}
+
+// Wall is the clock of the machine.
+var Wall Clock = wallClock{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// epoch is where every virtual clock starts, so two runs with the same
+// seed see the same times.
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type timer struct {
+	at  time.Time
+	seq int
+	c   chan time.Time
+}
+
+// Virtual is a clock that stands still until Advance is called.
+type Virtual struct {
+	lock     sync.Mutex
+	now      time.Time
+	timers   []*timer
+	seq      int // timers ever set
+	busy     int // callers of Busy not done yet
+	done     int // callers of Busy done
+	released bool
+}
+
+func NewVirtual() *Virtual {
+	return &Virtual{now: epoch}
+}
+
+func (c *Virtual) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *Virtual) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *Virtual) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	c.seq++
+	if d <= 0 || c.released {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, &timer{c.now.Add(d), c.seq, ch})
+	sort.Slice(c.timers, func(i, j int) bool {
+		if c.timers[i].at.Equal(c.timers[j].at) {
+			return c.timers[i].seq < c.timers[j].seq
+		}
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+	return ch
+}
+
+// Next returns when the earliest pending timer fires.
+func (c *Virtual) Next() (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	return c.timers[0].at, true
+}
+
+// Busy tells the scheduler behind clock, if there is one, that the caller
+// works outside the simulation, such as writing a file. The scheduler
+// holds still until the caller calls the returned function.
+func Busy(clock Clock) func() {
+	c, ok := clock.(*Virtual)
+	if !ok {
+		return func() {}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.busy++
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.busy--
+		c.done++
+	}
+}
+
+// activity returns how many timers were ever set and how many callers of
+// Busy are done, which only grows while the nodes are on their way, and
+// how many callers of Busy are not done yet.
+func (c *Virtual) activity() (int, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.seq + c.done, c.busy
+}
+
+// Advance moves the clock to t and fires every timer due by then. It
+// returns how many fired. The clock never goes backwards.
+func (c *Virtual) Advance(t time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+	fired := 0
+	for len(c.timers) > 0 && !c.timers[0].at.After(c.now) {
+		c.timers[0].c <- c.timers[0].at
+		c.timers = c.timers[1:]
+		fired++
+	}
+	return fired
+}
+
+// release fires every timer, and any timer set from now on, at once.
+func (c *Virtual) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.released = true
+	for _, t := range c.timers {
+		t.c <- c.now
+	}
+	c.timers = nil
+}
@@ -0,0 +1,337 @@
+package sim
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"transport"
+)
+
+// SeedEnv names the environment variable that replays a run: set it to
+// the seed a failed run printed.
+const SeedEnv = "SIM_SEED"
+
+// steps in a row with nothing to deliver and no timer set before Run
+// gives up on the nodes
+const maxIdle = 1000
+
+// yields of the scheduler in a row that have to pass without the nodes
+// sending, setting a timer, returning from a handler or ending a Busy
+// stretch before they count as blocked
+const quietRounds = 1000
+
+// Faults says how badly the simulated network behaves. Every decision is
+// drawn from the seeded source of the simulator.
+type Faults struct {
+	Loss      float64       // chance a message is dropped
+	Duplicate float64       // chance a request is delivered twice
+	Reorder   float64       // chance a message overtakes others that are due
+	MaxDelay  time.Duration // a message is held back up to this long
+}
+
+type message struct {
+	from    string
+	to      string
+	key     string // orders messages that are due at the same time
+	at      time.Time
+	delayed bool
+	deliver func(duplicate bool)
+	lose    func()
+}
+
+// Simulator runs nodes on a virtual clock and a simulated network. Nodes
+// only ever talk through it, and it moves one message or one clock tick
+// at a time, once every goroutine of the nodes is blocked, choosing with
+// a source seeded by the seed it was made with. The same seed replays the
+// same run, and the same trace.
+type Simulator struct {
+	// atomic, and first to stay 64-bit aligned
+	handlers int64 // delivered requests whose handler has not returned
+	events   int64 // messages sent and handlers returned
+
+	lock    sync.Mutex
+	seed    int64
+	rng     *rand.Rand
+	clock   *Virtual
+	network *transport.MemNetwork
+	faults  Faults
+	groups  map[string]int
+	crashed map[string]bool
+	queue   []*message
+	stopped bool
+	trace   []string
+}
+
+func New(seed int64) *Simulator {
+	s := &Simulator{
+		seed:    seed,
+		rng:     rand.New(rand.NewSource(seed)),
+		clock:   NewVirtual(),
+		network: transport.NewMemNetwork(),
+		groups:  make(map[string]int),
+		crashed: make(map[string]bool),
+	}
+	return s
+}
+
+// SeedFromEnv returns the seed to replay from SeedEnv, or a fresh one.
+func SeedFromEnv() int64 {
+	if seed, err := strconv.ParseInt(os.Getenv(SeedEnv), 10, 64); err == nil {
+		return seed
+	}
+	return time.Now().UnixNano()
+}
+
+func (s *Simulator) Seed() int64 {
+	return s.seed
+}
+
+// String is what a failed run should print.
+func (s *Simulator) String() string {
+	return fmt.Sprintf("seed %d (replay with %s=%d)", s.seed, SeedEnv, s.seed)
+}
+
+// Clock is the virtual clock every node of the simulation has to use.
+func (s *Simulator) Clock() Clock {
+	return s.clock
+}
+
+// Int63 draws from the seeded source, for seeding the nodes themselves.
+func (s *Simulator) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rng.Int63()
+}
+
+func (s *Simulator) SetFaults(faults Faults) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = faults
+}
+
+// Partition splits the nodes into groups that cannot reach each other.
+// Nodes not named in any group form one more group together.
+func (s *Simulator) Partition(groups ...[]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			s.groups[node] = i + 1
+		}
+	}
+}
+
+// Heal undoes Partition.
+func (s *Simulator) Heal() {
+	s.Partition()
+}
+
+// Crash cuts a node off: whatever it sends or is sent is lost, including
+// messages already under way. Stopping the node itself is up to the
+// caller, Restart lets a new one at the same address talk again.
+func (s *Simulator) Crash(node string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.crashed[node] = true
+}
+
+func (s *Simulator) Restart(node string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.crashed, node)
+}
+
+// Run drives the simulation until done returns true, and fails with the
+// seed in its error if that has not happened after limit of virtual time.
+func (s *Simulator) Run(done func() bool, limit time.Duration) error {
+	deadline := s.clock.Now().Add(limit)
+	for idle := 0; ; {
+		s.settle()
+		if done() {
+			return nil
+		}
+		if s.step() {
+			idle = 0
+			continue
+		}
+		at, ok := s.next()
+		if !ok {
+			// nothing scheduled, but a node may still be on its way
+			if idle++; idle > maxIdle {
+				return s.fail("nothing left to run at %v", s.clock.Now().Sub(epoch))
+			}
+			continue
+		}
+		idle = 0
+		if at.After(deadline) {
+			return s.fail("not done after %v", limit)
+		}
+		s.clock.Advance(at)
+	}
+}
+
+// Stop loses every message under way and lets every timer fire at once,
+// so nodes closed after a run can wind down without the scheduler.
+func (s *Simulator) Stop() {
+	s.lock.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.stopped = true
+	s.lock.Unlock()
+	for _, m := range queue {
+		m.lose()
+	}
+	s.clock.release()
+}
+
+// Trace returns what the scheduler did so far, one line per message it
+// delivered, lost or held back.
+func (s *Simulator) Trace() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.trace...)
+}
+
+func (s *Simulator) fail(format string, args ...interface{}) error {
+	return fmt.Errorf("sim: %v: %v", s, fmt.Sprintf(format, args...))
+}
+
+// settle waits until the nodes are blocked: all of them wait on the
+// virtual clock, on the simulated network or on each other. Only then
+// does what the scheduler picks stop depending on how Go happened to run
+// the goroutines of the nodes. The work the scheduler handed out is
+// counted: a delivered request until its handler returns, and anything a
+// node marked with Busy until it is done. After that the nodes still get
+// quietRounds yields in a row without a message sent, a timer set or any
+// of that work ending, for what they do in between.
+func (s *Simulator) settle() {
+	for quiet := 0; quiet < quietRounds; {
+		before, _ := s.activity()
+		runtime.Gosched()
+		after, working := s.activity()
+		if after != before || working > 0 {
+			quiet = 0
+		} else {
+			quiet++
+		}
+	}
+}
+
+// activity returns a count that grows with every message sent, timer
+// set and piece of counted work that ended, and how much counted work is
+// still going on.
+func (s *Simulator) activity() (int64, int64) {
+	events, busy := s.clock.activity()
+	return atomic.LoadInt64(&s.events) + int64(events), atomic.LoadInt64(&s.handlers) + int64(busy)
+}
+
+// serve runs the handler of a delivered request on its own goroutine and
+// tells settle about it.
+func (s *Simulator) serve(handler func()) {
+	atomic.AddInt64(&s.handlers, 1)
+	go func() {
+		handler()
+		atomic.AddInt64(&s.events, 1)
+		atomic.AddInt64(&s.handlers, -1)
+	}()
+}
+
+// send queues a message; the scheduler later either delivers or loses it.
+func (s *Simulator) send(from string, to string, key string, deliver func(bool), lose func()) {
+	atomic.AddInt64(&s.events, 1)
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		lose()
+		return
+	}
+	defer s.lock.Unlock()
+	s.queue = append(s.queue, &message{from, to, key, s.clock.Now(), false, deliver, lose})
+}
+
+// step handles one message that is due, and returns false if there is none.
+func (s *Simulator) step() bool {
+	s.lock.Lock()
+	now := s.clock.Now()
+	due := []*message{}
+	for _, m := range s.queue {
+		if !m.at.After(now) {
+			due = append(due, m)
+		}
+	}
+	if len(due) == 0 {
+		s.lock.Unlock()
+		return false
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		if !due[i].at.Equal(due[j].at) {
+			return due[i].at.Before(due[j].at)
+		}
+		return due[i].key < due[j].key
+	})
+	m := due[0]
+	if s.rng.Float64() < s.faults.Reorder {
+		m = due[s.rng.Intn(len(due))]
+	}
+	for i := range s.queue {
+		if s.queue[i] == m {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+
+	var action func()
+	what := "deliver"
+	switch {
+	case s.cut(m.from, m.to) || s.rng.Float64() < s.faults.Loss:
+		action = m.lose
+		what = "lose"
+	case !m.delayed && s.faults.MaxDelay > 0:
+		m.delayed = true
+		m.at = now.Add(time.Duration(s.rng.Int63n(int64(s.faults.MaxDelay))))
+		s.queue = append(s.queue, m)
+		what = "delay until " + m.at.Sub(epoch).String()
+	default:
+		duplicate := s.rng.Float64() < s.faults.Duplicate
+		if duplicate {
+			what = "deliver twice"
+		}
+		action = func() {
+			m.deliver(false)
+			if duplicate {
+				m.deliver(true)
+			}
+		}
+	}
+	s.trace = append(s.trace, fmt.Sprintf("%v %v: %v", now.Sub(epoch), what, m.key))
+	s.lock.Unlock()
+	if action != nil {
+		action()
+	}
+	return true
+}
+
+// cut tells whether from and to cannot talk; the caller holds lock.
+func (s *Simulator) cut(from string, to string) bool {
+	return s.crashed[from] || s.crashed[to] || s.groups[from] != s.groups[to]
+}
+
+// next returns when the next message or timer is due.
+func (s *Simulator) next() (time.Time, bool) {
+	at, ok := s.clock.Next()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, m := range s.queue {
+		if !ok || m.at.Before(at) {
+			at, ok = m.at, true
+		}
+	}
+	return at, ok
+}
@@ -0,0 +1,77 @@
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"transport"
+)
+
+// ErrLost is what a call returns when the simulated network lost the
+// request or its reply, as a reset connection would.
+var ErrLost = errors.New("sim: message lost")
+
+// simTransport sends every call of one node through the scheduler. The
+// calls themselves run over an in-memory network once they are delivered.
+type simTransport struct {
+	sim   *Simulator
+	node  string
+	inner transport.Transport
+}
+
+// Transport returns the transport of the node at address.
+func (s *Simulator) Transport(address string) transport.Transport {
+	return &simTransport{s, address, s.network.Transport()}
+}
+
+func (t *simTransport) Call(address string, serviceMethod string, args interface{}, reply interface{}) error {
+	return t.CallContext(context.Background(), address, serviceMethod, args, reply)
+}
+
+// CallContext stops waiting once ctx is done; the message still goes
+// through the scheduler, so the run stays the same.
+func (t *simTransport) CallContext(ctx context.Context, address string, serviceMethod string, args interface{}, reply interface{}) error {
+	done := make(chan error, 1)
+	lose := func() {
+		done <- ErrLost
+	}
+	// a duplicate is served like any request, but nobody waits for its reply
+	deliver := func(duplicate bool) {
+		r := reply
+		if duplicate {
+			r = reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+		}
+		t.sim.serve(func() {
+			err := t.inner.Call(address, serviceMethod, args, r)
+			if !duplicate {
+				t.sim.send(address, t.node, key(address, t.node, serviceMethod+" reply", r), func(bool) {
+					done <- err
+				}, lose)
+			}
+		})
+	}
+	t.sim.send(t.node, address, key(t.node, address, serviceMethod, args), deliver, lose)
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *simTransport) Listen(address string) (net.Listener, error) {
+	return t.inner.Listen(address)
+}
+
+func (t *simTransport) Close() error {
+	return t.inner.Close()
+}
+
+// key describes a message by its content, so messages sent at the same
+// virtual time are delivered in an order that does not depend on which
+// goroutine got to send first.
+func key(from string, to string, serviceMethod string, payload interface{}) string {
+	return fmt.Sprintf("%v>%v %v %+v", from, to, serviceMethod, payload)
+}
@@ -0,0 +1,123 @@
+package sim
+
+import "testing"
+import "net/rpc"
+import "fmt"
+import "strconv"
+import "sync"
+import "time"
+
+type Log struct {
+	lock     sync.Mutex
+	received []string
+}
+
+func (l *Log) Append(args *string, reply *int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.received = append(l.received, *args)
+	*reply = len(l.received)
+	return nil
+}
+
+// run lets a few clients call one server over a lossy network and
+// returns what the server received, in order.
+func run(t *testing.T, seed int64) []string {
+	s := New(seed)
+	defer s.Stop()
+	s.SetFaults(Faults{Loss: 0.2, Duplicate: 0.2, Reorder: 0.5, MaxDelay: 10 * time.Millisecond})
+
+	l := &Log{}
+	rpcs := rpc.NewServer()
+	rpcs.Register(l)
+	listener, err := s.Transport("server").Listen("server")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for c := 0; c < 3; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			tr := s.Transport("client-" + strconv.Itoa(c))
+			for i := 0; i < 5; i++ {
+				msg := strconv.Itoa(c) + "-" + strconv.Itoa(i)
+				var reply int
+				tr.Call("server", "Log.Append", &msg, &reply)
+				s.Clock().Sleep(time.Millisecond)
+			}
+		}(c)
+	}
+	finished := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	err = s.Run(func() bool {
+		select {
+		case <-finished:
+			return true
+		default:
+			return false
+		}
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string{}, l.received...)
+}
+
+func TestVirtualClock(t *testing.T) {
+	fmt.Printf("Test: Virtual clock ...\n")
+
+	c := NewVirtual()
+	start := c.Now()
+	late := c.After(20 * time.Millisecond)
+	early := c.After(10 * time.Millisecond)
+	if at, _ := c.Next(); at != start.Add(10*time.Millisecond) {
+		t.Fatalf("next timer at %v, expected %v", at, start.Add(10*time.Millisecond))
+	}
+	if fired := c.Advance(start.Add(15 * time.Millisecond)); fired != 1 {
+		t.Fatalf("%v timers fired, expected 1", fired)
+	}
+	select {
+	case <-early:
+	default:
+		t.Fatalf("early timer did not fire")
+	}
+	select {
+	case <-late:
+		t.Fatalf("late timer fired early")
+	default:
+	}
+	c.Advance(start)
+	if c.Now() != start.Add(15*time.Millisecond) {
+		t.Fatalf("clock went backwards")
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestReplay(t *testing.T) {
+	fmt.Printf("Test: Same seed, same run ...\n")
+
+	seed := SeedFromEnv()
+	first := run(t, seed)
+	second := run(t, seed)
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatalf("seed %v: runs differ\n%v\n%v", seed, first, second)
+	}
+	fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,75 @@
+package tests
+
+import "testing"
+import "server"
+import "transport"
+import "strconv"
+import "fmt"
+import "sync/atomic"
+import "time"
+
+// countingCodec counts the log entries that carry a Get.
+type countingCodec struct {
+	server.Codec
+	gets *int32
+}
+
+func (c countingCodec) Encode(b server.Batch) ([]byte, error) {
+	for _, r := range b.Requests {
+		if r.Name == "Get" {
+			atomic.AddInt32(c.gets, 1)
+			break
+		}
+	}
+	return c.Codec.Encode(b)
+}
+
+// the leader answers Gets from its own copy while it holds a lease, and
+// after it is gone the next leader sees every write
+func TestLeaseReads(t *testing.T) {
+
+	const serverNum = 3
+	const lease = time.Second
+	fmt.Printf("Lease Test: reads on the leader skip the log ...\n")
+
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	var gets []int32 = make([]int32, serverNum)
+	defer Close(servers)
+
+	network := transport.NewMemNetwork()
+	for i := 0; i < serverNum; i++ {
+		address[i] = "lease-" + strconv.Itoa(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		config := &server.Config{
+			Transport: network.Transport(),
+			Codec:     countingCodec{server.GobCodec, &gets[i]},
+			Lease:     lease,
+		}
+		servers[i], _ = server.NewServerWithConfig(address, i, config)
+	}
+
+	leader := MakeFakeAgent(servers[0:1])
+	leader.Put("key", "0")
+	time.Sleep(lease / 10)
+	for i := 1; i <= 10; i++ {
+		// writes through a follower end up with the leader
+		MakeFakeAgent(servers[1:2]).Put("key", strconv.Itoa(i))
+		if v := leader.GetFrom("key", 0); v != strconv.Itoa(i) {
+			t.Fatalf("leader read %v, expected %v", v, i)
+		}
+	}
+	if n := atomic.LoadInt32(&gets[0]); n != 0 {
+		t.Fatalf("leader logged %v Gets while holding a lease", n)
+	}
+
+	servers[0].Close()
+	servers[0] = nil
+	follower := MakeFakeAgent(servers[1:2])
+	follower.Put("key", "after")
+	if v := follower.GetFrom("key", 0); v != "after" {
+		t.Fatalf("read %v after the leader left, expected after", v)
+	}
+	fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,56 @@
+package tests
+
+import "testing"
+import "server"
+import "strconv"
+import "fmt"
+import "time"
+
+// every server gets a stream of Puts at the same time, so their
+// proposers keep colliding; backoff lets them all get through
+func TestDuelingServers(t *testing.T) {
+
+	const serverNum = 5
+	const putNum = 20
+	fmt.Printf("Dueling Test: concurrent Puts on every server ...\n")
+
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	defer Close(servers)
+
+	for i := 0; i < serverNum; i++ {
+		address[i] = CreateAddress(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		servers[i], _ = server.NewServer(address, i, false, false)
+	}
+
+	start := time.Now()
+	var finish [serverNum]chan int
+	for i := 0; i < serverNum; i++ {
+		finish[i] = make(chan int)
+		go func(me int) {
+			defer func() { finish[me] <- 0 }()
+			ag := MakeFakeAgent(servers[me : me+1])
+			for k := 0; k < putNum; k++ {
+				ag.Put("key"+strconv.Itoa(me), strconv.Itoa(k))
+			}
+		}(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		<-finish[i]
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Fatalf("%v Puts took %v", serverNum*putNum, elapsed)
+	}
+
+	ag := MakeFakeAgent(servers)
+	for i := 0; i < serverNum; i++ {
+		for k := 0; k < serverNum; k++ {
+			if v := ag.GetFrom("key"+strconv.Itoa(k), i); v != strconv.Itoa(putNum-1) {
+				t.Fatalf("server %v: key%v -> %v, expected %v", i, k, v, putNum-1)
+			}
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
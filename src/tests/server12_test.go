@@ -0,0 +1,72 @@
+package tests
+
+import "testing"
+import "server"
+import "strconv"
+import "strings"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+
+// every server serves its counters to a Prometheus scrape
+func TestMetrics(t *testing.T) {
+
+	const serverNum = 3
+	fmt.Printf("Metrics Test: scrape /metrics after some Puts ...\n")
+
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	var metrics []string = make([]string, serverNum)
+	defer Close(servers)
+
+	for i := 0; i < serverNum; i++ {
+		address[i] = CreateAddress(i)
+		metrics[i] = CreateAddress(100 + i)
+	}
+	for i := 0; i < serverNum; i++ {
+		var err error
+		servers[i], err = server.NewServerWithConfig(address, i, &server.Config{MetricsAddress: metrics[i]})
+		if err != nil {
+			t.Fatalf("NewServerWithConfig: %v", err)
+		}
+	}
+
+	ag := MakeFakeAgent(servers[0:1])
+	for i := 0; i < 10; i++ {
+		ag.Put("key", strconv.Itoa(i))
+	}
+
+	response, err := http.Get("http://" + metrics[0] + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	samples := map[string]string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		samples[line[:i]] = line[i+1:]
+	}
+
+	for _, name := range []string{"paxos_proposals_decided_total", "server_requests_applied_total", "paxos_rounds_per_decision_count"} {
+		if n, _ := strconv.Atoi(samples[name]); n == 0 {
+			t.Fatalf("%v is %q, expected more than 0", name, samples[name])
+		}
+	}
+	if samples[`paxos_rounds_per_decision_bucket{le="+Inf"}`] != samples["paxos_rounds_per_decision_count"] {
+		t.Fatalf("the last bucket does not hold every observation")
+	}
+	for i := 1; i < serverNum; i++ {
+		sent := fmt.Sprintf(`paxos_rpcs_sent_total{peer=%q,phase="Accept"}`, address[i])
+		if n, _ := strconv.Atoi(samples[sent]); n == 0 {
+			t.Fatalf("no Accepts to server %v counted", i)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,65 @@
+package tests
+
+import "testing"
+import "server"
+import "transport"
+import "strconv"
+import "fmt"
+import "runtime"
+import "time"
+
+// requests stuck on a server without a majority fail once it closes, and
+// nothing of the cluster keeps running after Close
+func TestCloseWakesClients(t *testing.T) {
+
+	const serverNum = 3
+	const clientNum = 4
+	fmt.Printf("Close Test: waiting clients get an error, no goroutine leaks ...\n")
+
+	before := runtime.NumGoroutine()
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	defer Close(servers)
+
+	network := transport.NewMemNetwork()
+	for i := 0; i < serverNum; i++ {
+		address[i] = "close-" + strconv.Itoa(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		servers[i], _ = server.NewServerWithConfig(address, i, &server.Config{Transport: network.Transport()})
+	}
+	MakeFakeAgent(servers[0:1]).Put("key", "0")
+
+	servers[1].Close()
+	servers[2].Close()
+	errs := make(chan error, 2*clientNum)
+	for c := 0; c < clientNum; c++ {
+		go func(me int) {
+			errs <- servers[0].Put(&server.PutArgs{AgentID: me, RequestID: 1, Key: "key", Value: "1"}, &server.PutReply{})
+		}(c)
+		go func(me int) {
+			errs <- servers[0].Get(&server.GetArgs{AgentID: me, RequestID: 2, Key: "key"}, &server.GetReply{})
+		}(c)
+	}
+	time.Sleep(200 * time.Millisecond)
+	servers[0].Close()
+	for i := 0; i < 2*clientNum; i++ {
+		select {
+		case err := <-errs:
+			if err != server.ErrClosed {
+				t.Fatalf("request on a closed server: %v, expected %v", err, server.ErrClosed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("a request is still waiting after Close")
+		}
+	}
+
+	for iters := 0; runtime.NumGoroutine() > before; iters++ {
+		if iters == 50 {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%v goroutines left, %v before:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Printf("  ... Passed\n")
+}
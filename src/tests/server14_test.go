@@ -0,0 +1,101 @@
+package tests
+
+import "testing"
+import "server"
+import "shard"
+import "transport"
+import "strconv"
+import "fmt"
+import "time"
+
+// groups of a sharded cluster keep only the keys of their shards, and a
+// client finds them through the controller
+func TestShards(t *testing.T) {
+
+	const ctrlNum = 3
+	const groupNum = 3
+	const serverNum = 3
+	const keyNum = 30
+	fmt.Printf("Shard Test: groups serve only their shards ...\n")
+
+	network := transport.NewMemNetwork()
+	controllers := make([]string, ctrlNum)
+	for i := range controllers {
+		controllers[i] = "shard-ctrl-" + strconv.Itoa(i)
+	}
+	for i := range controllers {
+		c, err := shard.NewController(controllers, i, network.Transport())
+		if err != nil {
+			t.Fatalf("NewController: %v", err)
+		}
+		defer c.Close()
+	}
+
+	groups := make(map[int][]server.Server)
+	addresses := make(map[int][]string)
+	for gid := 1; gid <= groupNum; gid++ {
+		addresses[gid] = make([]string, serverNum)
+		for i := range addresses[gid] {
+			addresses[gid][i] = "shard-" + strconv.Itoa(gid) + "-" + strconv.Itoa(i)
+		}
+		groups[gid] = make([]server.Server, serverNum)
+		defer Close(groups[gid])
+		for i := range addresses[gid] {
+			config := &server.Config{Transport: network.Transport(), GID: gid, Controllers: controllers}
+			groups[gid][i], _ = server.NewServerWithConfig(addresses[gid], i, config)
+		}
+	}
+
+	ck := shard.NewClerk(controllers, network.Transport())
+	for gid := 1; gid <= groupNum; gid++ {
+		if err := ck.Join(gid, addresses[gid]); err != nil {
+			t.Fatalf("Join: %v", err)
+		}
+	}
+	config, _ := ck.Query(-1)
+
+	// a group refuses keys until it has caught up with the controller
+	put := func(key string, value string) {
+		for iters := 0; ; iters++ {
+			gid := config.Shards[shard.KeyShard(key)]
+			err := groups[gid][iters%serverNum].Put(&server.PutArgs{1, time.Now().UnixNano(), key, value}, &server.PutReply{})
+			if err == nil {
+				return
+			}
+			if (err != server.ErrWrongGroup && err != server.ErrMigrating) || iters == 50 {
+				t.Fatalf("Put %v to group %v: %v", key, gid, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	for i := 0; i < keyNum; i++ {
+		put("key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	for i := 0; i < keyNum; i++ {
+		key := "key" + strconv.Itoa(i)
+		gid := config.Shards[shard.KeyShard(key)]
+		reply := &server.GetReply{}
+		if err := groups[gid][0].Get(&server.GetArgs{1, time.Now().UnixNano(), key}, reply); err != nil || reply.Value != strconv.Itoa(i) {
+			t.Fatalf("Get %v from group %v: %v, %v", key, gid, reply.Value, err)
+		}
+		other := gid%groupNum + 1
+		// the shard may have passed through other on its way
+		if err := groups[other][0].Get(&server.GetArgs{1, time.Now().UnixNano(), key}, &server.GetReply{}); err != server.ErrWrongGroup && err != server.ErrMigrating {
+			t.Fatalf("Get %v from group %v: %v, expected %v", key, other, err, server.ErrWrongGroup)
+		}
+	}
+
+	total := 0
+	for gid := 1; gid <= groupNum; gid++ {
+		size := groups[gid][0].StorageSize()
+		if size >= keyNum*2 {
+			t.Fatalf("group %v applied %v requests, it should keep only its shards", gid, size)
+		}
+		total += size
+	}
+	if total != keyNum*2 {
+		t.Fatalf("groups applied %v requests, expected %v", total, keyNum*2)
+	}
+	fmt.Printf("  ... Passed\n")
+}
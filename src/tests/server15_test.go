@@ -0,0 +1,221 @@
+package tests
+
+import "testing"
+import "server"
+import "shard"
+import "transport"
+import "strconv"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "math/rand"
+import "sync"
+import "time"
+
+// a client of a sharded cluster: it finds the group of a key through the
+// controller and sends one request at a time
+type ShardAgent struct {
+	t       *testing.T
+	agentID int
+	clerk   *shard.Clerk
+	groups  map[int][]server.Server
+}
+
+func (sa *ShardAgent) call(key string, f func(s server.Server) error) {
+	for iters := 0; ; iters++ {
+		err := server.ErrWrongGroup
+		if gid, _ := sa.clerk.Servers(key); gid != 0 {
+			err = f(sa.groups[gid][rand.Int()%len(sa.groups[gid])])
+		}
+		if err == nil {
+			return
+		}
+		if (err != server.ErrWrongGroup && err != server.ErrMigrating) || iters == 200 {
+			sa.t.Errorf("agent %v, key %v: %v", sa.agentID, key, err)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		sa.clerk.Query(-1)
+	}
+}
+
+func (sa *ShardAgent) Put(args *server.PutArgs) {
+	sa.call(args.Key, func(s server.Server) error {
+		return s.Put(args, &server.PutReply{})
+	})
+}
+
+func (sa *ShardAgent) Get(key string) string {
+	reply := &server.GetReply{}
+	sa.call(key, func(s server.Server) error {
+		return s.Get(&server.GetArgs{sa.agentID, time.Now().UnixNano(), key}, reply)
+	})
+	return reply.Value
+}
+
+// shards move between groups while clients keep writing, and no write is
+// lost or applied twice
+func TestMigration(t *testing.T) {
+
+	const ctrlNum = 3
+	const groupNum = 3
+	const serverNum = 3
+	const clientNum = 5
+	fmt.Printf("Shard Test: shards move between groups under load ...\n")
+
+	network := transport.NewMemNetwork()
+	controllers := make([]string, ctrlNum)
+	for i := range controllers {
+		controllers[i] = "move-ctrl-" + strconv.Itoa(i)
+	}
+	for i := range controllers {
+		c, err := shard.NewController(controllers, i, network.Transport())
+		if err != nil {
+			t.Fatalf("NewController: %v", err)
+		}
+		defer c.Close()
+	}
+
+	groups := make(map[int][]server.Server)
+	addresses := make(map[int][]string)
+	for gid := 1; gid <= groupNum; gid++ {
+		addresses[gid] = make([]string, serverNum)
+		for i := range addresses[gid] {
+			addresses[gid][i] = "move-" + strconv.Itoa(gid) + "-" + strconv.Itoa(i)
+		}
+		groups[gid] = make([]server.Server, serverNum)
+		defer Close(groups[gid])
+		for i := range addresses[gid] {
+			config := &server.Config{Transport: network.Transport(), GID: gid, Controllers: controllers}
+			groups[gid][i], _ = server.NewServerWithConfig(addresses[gid], i, config)
+		}
+	}
+	admin := shard.NewClerk(controllers, network.Transport())
+	admin.Join(1, addresses[1])
+
+	// every client writes keys of its own, and overwrites one of them
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	agents := make([]*ShardAgent, clientNum)
+	first := make([]*server.PutArgs, clientNum)
+	counts := make([]int, clientNum)
+	for c := 0; c < clientNum; c++ {
+		agents[c] = &ShardAgent{t, c + 1, shard.NewClerk(controllers, network.Transport()), groups}
+		agents[c].clerk.Query(-1)
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			sa := agents[c]
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					counts[c] = i
+					return
+				default:
+				}
+				value := strconv.Itoa(i)
+				sa.Put(&server.PutArgs{sa.agentID, time.Now().UnixNano(), "k" + strconv.Itoa(c) + "-" + value, value})
+				last := &server.PutArgs{sa.agentID, time.Now().UnixNano(), "k" + strconv.Itoa(c), value}
+				if i == 0 {
+					first[c] = last
+				}
+				sa.Put(last)
+			}
+		}(c)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	admin.Join(2, addresses[2])
+	time.Sleep(500 * time.Millisecond)
+	admin.Join(3, addresses[3])
+	time.Sleep(500 * time.Millisecond)
+	admin.Leave(1)
+	time.Sleep(500 * time.Millisecond)
+	admin.Move(0, 2)
+	admin.Move(1, 2)
+	time.Sleep(500 * time.Millisecond)
+	admin.Join(1, addresses[1])
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	for c := 0; c < clientNum; c++ {
+		sa := agents[c]
+		if counts[c] == 0 {
+			t.Fatalf("client %v wrote nothing", c)
+		}
+		for i := 0; i < counts[c]; i++ {
+			value := strconv.Itoa(i)
+			if got := sa.Get("k" + strconv.Itoa(c) + "-" + value); got != value {
+				t.Fatalf("client %v lost write %v: got %q", c, i, got)
+			}
+		}
+		// a late retry of a request applied long ago, likely in another
+		// group, must not undo the writes after it
+		sa.Put(first[c])
+		if got := sa.Get("k" + strconv.Itoa(c)); got != strconv.Itoa(counts[c]-1) {
+			t.Fatalf("client %v: last write is %q, expected %q", c, got, strconv.Itoa(counts[c]-1))
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// entries that apply nothing, like a retried Put, still leave a line in
+// the text log, so a restart resumes after them
+func TestSkippedEntriesLogged(t *testing.T) {
+
+	const serverNum = 3
+	fmt.Printf("Shard Test: duplicate requests are logged as applied ...\n")
+
+	dir, err := ioutil.TempDir("", "skipped")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	network := transport.NewMemNetwork()
+	controllers := []string{"skip-ctrl"}
+	c, err := shard.NewController(controllers, 0, network.Transport())
+	if err != nil {
+		t.Fatalf("NewController: %v", err)
+	}
+	defer c.Close()
+
+	servers := make([]server.Server, serverNum)
+	address := make([]string, serverNum)
+	for i := range address {
+		address[i] = "skip-" + strconv.Itoa(i)
+	}
+	defer Close(servers)
+	for i := range address {
+		config := &server.Config{Transport: network.Transport(), GID: 1, Controllers: controllers, NeedFile: true, LogDir: dir, SnapshotEvery: 1000}
+		servers[i], _ = server.NewServerWithConfig(address, i, config)
+	}
+	shard.NewClerk(controllers, network.Transport()).Join(1, address)
+
+	put := func(args *server.PutArgs) {
+		for iters := 0; ; iters++ {
+			err := servers[0].Put(args, &server.PutReply{})
+			if err == nil {
+				return
+			}
+			if (err != server.ErrWrongGroup && err != server.ErrMigrating) || iters == 50 {
+				t.Fatalf("Put: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	args := &server.PutArgs{AgentID: 1, RequestID: 5, Key: "key", Value: "value"}
+	put(args)
+	before := lastRid(dir + "/log_" + address[0])
+	for i := 0; i < 3; i++ {
+		put(args)
+	}
+	if after := lastRid(dir + "/log_" + address[0]); after < before+3 {
+		t.Fatalf("log ends at entry %v after three more entries, was %v", after, before)
+	}
+	fmt.Printf("  ... Passed\n")
+}
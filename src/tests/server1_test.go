@@ -5,6 +5,7 @@ import "strconv"
 import "time"
 import "fmt"
 import "server"
+import "transport"
 import "math/rand"
 
 type FakeAgent struct {
@@ -124,6 +125,42 @@ func TestBasic(t *testing.T) {
 
 }
 
+func TestInMemory(t *testing.T) {
+
+	const serverNum = 3
+
+	fmt.Printf("In-memory Test: 3 servers put/get without real ports ...\n")
+
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	defer Close(servers)
+
+	network := transport.NewMemNetwork()
+	for i := 0; i < serverNum; i++ {
+		address[i] = "mem-" + strconv.Itoa(i)
+	}
+	var err error
+	for i := 0; i < serverNum; i++ {
+		config := &server.Config{Transport: network.Transport()}
+		servers[i], err = server.NewServerWithConfig(address, i, config)
+		if servers[i] == nil {
+			t.Fatalf("NewServerWithConfig: %v", err)
+		}
+	}
+
+	ag := MakeFakeAgent(servers)
+	for i := 0; i < 10; i++ {
+		ag.Put("key", strconv.Itoa(i))
+	}
+	for i := 0; i < serverNum; i++ {
+		if v := ag.GetFrom("key", i); v != "9" {
+			t.Fatalf("server %v has %v, expected 9", i, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
 func TestOrder(t *testing.T) {
 
 	const serverNum = 10
@@ -207,6 +244,51 @@ func TestConcurrent(t *testing.T) {
 	time.Sleep(2 * time.Second)
 }
 
+func TestPipelined(t *testing.T) {
+
+	const serverNum = 3
+	const requestNum = 30
+	fmt.Printf("Pipelined Test: %d requests in flight on one server ...\n", requestNum)
+
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	defer Close(servers)
+
+	for i := 0; i < serverNum; i++ {
+		address[i] = CreateAddress(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		servers[i], _ = server.NewServer(address, i, false, false)
+	}
+
+	agent := MakeFakeAgent(servers[:1])
+	finish := make(chan int)
+	for i := 0; i < requestNum; i++ {
+		go func(me int) {
+			defer func() { finish <- 0 }()
+			agent.Put("key"+strconv.Itoa(me), strconv.Itoa(me))
+		}(i)
+	}
+	for i := 0; i < requestNum; i++ {
+		<-finish
+	}
+
+	reader := MakeFakeAgent(servers)
+	for i := 0; i < serverNum; i++ {
+		for j := 0; j < requestNum; j++ {
+			if v := reader.GetFrom("key"+strconv.Itoa(j), i); v != strconv.Itoa(j) {
+				t.Fatalf("key%v -> %v, expected %v", j, v, j)
+			}
+		}
+		if servers[i].StorageSize() < requestNum {
+			t.Fatalf("server %v applied %v requests, expected at least %v", i, servers[i].StorageSize(), requestNum)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	time.Sleep(1 * time.Second)
+}
+
 func TestRobust(t *testing.T) {
 
 	const serverNum = 3
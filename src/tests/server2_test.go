@@ -4,6 +4,7 @@ import "testing"
 import "time"
 import "fmt"
 import "server"
+import "transport"
 
 func TestDeadServer1(t *testing.T) {
 	const serverNum = 5
@@ -92,36 +93,87 @@ func TestDeadServer2(t *testing.T) {
 	time.Sleep(1 * time.Second)
 }
 
-func TestPartition1(t *testing.T) {
+// Partition cuts every link between servers of different groups, in both
+// directions, through SetLink. Without groups it heals every link.
+func Partition(servers []server.Server, address []string, groups ...[]int) {
+	group := make(map[string]int)
+	for g, members := range groups {
+		for _, i := range members {
+			group[address[i]] = g + 1
+		}
+	}
+	for i := range servers {
+		if servers[i] == nil {
+			continue
+		}
+		servers[i].SetLink(&server.LinkArgs{}, &server.LinkReply{})
+		for j := range address {
+			if group[address[i]] != group[address[j]] {
+				servers[i].SetLink(&server.LinkArgs{address[j], transport.Link{Partition: true}}, &server.LinkReply{})
+			}
+		}
+	}
+}
 
-	const groupServers = 2
-	const groups = 2
-	var servers_1 []server.Server = make([]server.Server, groupServers)
-	var servers_2 []server.Server = make([]server.Server, groupServers)
+// putAsync puts through agent on its own goroutine and closes the
+// returned channel once the put went through.
+func putAsync(agent *FakeAgent, key string, value string) chan bool {
+	done := make(chan bool)
+	go func() {
+		agent.Put(key, value)
+		close(done)
+	}()
+	return done
+}
 
-	var address_1 []string = make([]string, groupServers*groups)
-	var address_2 []string = make([]string, groupServers*groups)
+func finished(done chan bool, wait time.Duration) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
 
-	fmt.Printf("Partition Test1: 2 groups to test partition...\n")
-	defer Close(servers_1)
-	defer Close(servers_2)
+// a majority keeps going while cut off from a minority, which catches up
+// once the partition heals. The cut is one-way rules on both sides: the
+// majority gets refused, the minority gets no answer at all.
+func TestPartition1(t *testing.T) {
 
-	for i := 0; i < groupServers*2; i++ {
-		address_1[i] = CreateAddress(i)
-		address_2[i] = CreateAddress((i + groupServers) % (groupServers * groups))
-	}
+	const serverNum = 5
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
 
-	for i := 0; i < groupServers; i++ {
-		servers_1[i], _ = server.NewServer(address_1, i, false, false)
-		servers_2[i], _ = server.NewServer(address_2, i, false, false)
+	fmt.Printf("Partition Test1: majority and minority of one cluster...\n")
+	defer Close(servers)
 
+	for i := 0; i < serverNum; i++ {
+		address[i] = CreateAddress(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		servers[i], _ = server.NewServer(address, i, false, false)
+	}
+	majority, minority := []int{0, 1, 2}, []int{3, 4}
+	for _, i := range majority {
+		for _, j := range minority {
+			servers[i].SetLink(&server.LinkArgs{address[j], transport.Link{Partition: true}}, &server.LinkReply{})
+			servers[j].SetLink(&server.LinkArgs{address[i], transport.Link{Blackhole: true}}, &server.LinkReply{})
+		}
 	}
 
-	agent_1 := MakeFakeAgent(servers_1)
-	agent_2 := MakeFakeAgent(servers_2)
+	agent_1 := MakeFakeAgent(servers[0:3])
+	agent_2 := MakeFakeAgent(servers[3:5])
 
 	agent_1.Put("group1", "value1")
-	agent_2.Put("group2", "value2")
+	done := putAsync(agent_2, "group2", "value2")
+	if finished(done, 2*time.Second) {
+		t.Fatalf("minority made progress on its own")
+	}
+
+	Partition(servers, address)
+	if !finished(done, 10*time.Second) {
+		t.Fatalf("minority did not catch up after the partition healed")
+	}
 
 	agent_1.Assess(t, "group1", "value1")
 	agent_2.Assess(t, "group1", "value1")
@@ -133,42 +185,71 @@ func TestPartition1(t *testing.T) {
 	time.Sleep(1 * time.Second)
 }
 
+// three groups with no majority among them; the links are set through the
+// admin RPC of each server, as they would be on a live cluster
 func TestPartition2(t *testing.T) {
 
 	const groupServers = 3
 	const groups = 3
-	var servers_1 []server.Server = make([]server.Server, groupServers)
-	var servers_2 []server.Server = make([]server.Server, groupServers)
-	var servers_3 []server.Server = make([]server.Server, groupServers)
-
-	var address_1 []string = make([]string, groupServers*groups)
-	var address_2 []string = make([]string, groupServers*groups)
-	var address_3 []string = make([]string, groupServers*groups)
+	const serverNum = groupServers * groups
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
 
 	fmt.Printf("Partition Test2: 3 groups to test partition...\n")
-	defer Close(servers_1)
-	defer Close(servers_2)
-	defer Close(servers_3)
+	defer Close(servers)
 
-	for i := 0; i < groupServers*2; i++ {
-		address_1[i] = CreateAddress(i)
-		address_2[i] = CreateAddress(i + groupServers)
-		address_3[i] = CreateAddress((i + groupServers*2) % (groupServers * groups))
+	for i := 0; i < serverNum; i++ {
+		address[i] = CreateAddress(i)
 	}
+	for i := 0; i < serverNum; i++ {
+		servers[i], _ = server.NewServer(address, i, false, false)
+	}
+	admin := transport.NewTCPTransport()
+	defer admin.Close()
+	split := func(joined bool) {
+		for i := 0; i < serverNum; i++ {
+			admin.Call(address[i], "Server.SetLink", &server.LinkArgs{}, &server.LinkReply{})
+			for j := 0; j < serverNum; j++ {
+				g, h := i/groupServers, j/groupServers
+				if joined && g < 2 && h < 2 {
+					continue
+				}
+				if g != h {
+					reply := &server.LinkReply{}
+					err := admin.Call(address[i], "Server.SetLink", &server.LinkArgs{address[j], transport.Link{Partition: true}}, reply)
+					if err != nil || !reply.OK {
+						t.Fatalf("SetLink on server %v: %v", i, err)
+					}
+				}
+			}
+		}
+	}
+	split(false)
 
-	for i := 0; i < groupServers; i++ {
-		servers_1[i], _ = server.NewServer(address_1, i, false, false)
-		servers_2[i], _ = server.NewServer(address_2, i, false, false)
-		servers_3[i], _ = server.NewServer(address_3, i, false, false)
+	agent_1 := MakeFakeAgent(servers[0:3])
+	agent_2 := MakeFakeAgent(servers[3:6])
+	agent_3 := MakeFakeAgent(servers[6:9])
+
+	done_1 := putAsync(agent_1, "group1", "value1")
+	done_2 := putAsync(agent_2, "group2", "value2")
+	done_3 := putAsync(agent_3, "group3", "value3")
+	if finished(done_1, 2*time.Second) || finished(done_2, 0) || finished(done_3, 0) {
+		t.Fatalf("a group without a majority made progress")
 	}
 
-	agent_1 := MakeFakeAgent(servers_1)
-	agent_2 := MakeFakeAgent(servers_2)
-	agent_3 := MakeFakeAgent(servers_3)
+	// groups 1 and 2 together are a majority
+	split(true)
+	if !finished(done_1, 10*time.Second) || !finished(done_2, 10*time.Second) {
+		t.Fatalf("groups 1 and 2 made no progress together")
+	}
+	if finished(done_3, time.Second) {
+		t.Fatalf("group 3 made progress on its own")
+	}
 
-	agent_1.Put("group1", "value1")
-	agent_2.Put("group2", "value2")
-	agent_3.Put("group3", "value3")
+	Partition(servers, address)
+	if !finished(done_3, 10*time.Second) {
+		t.Fatalf("group 3 did not catch up after the partition healed")
+	}
 
 	agent_1.Assess(t, "group1", "value1")
 	agent_2.Assess(t, "group1", "value1")
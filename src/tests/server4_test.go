@@ -0,0 +1,111 @@
+package tests
+
+import "testing"
+import "server"
+import "transport"
+import "strconv"
+import "fmt"
+import "time"
+
+func makeMemCluster(serverNum int, maxBatchSize int, batchDelay time.Duration) []server.Server {
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+
+	network := transport.NewMemNetwork()
+	for i := 0; i < serverNum; i++ {
+		address[i] = "batch-" + strconv.Itoa(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		config := &server.Config{
+			Transport:    network.Transport(),
+			MaxBatchSize: maxBatchSize,
+			BatchDelay:   batchDelay,
+		}
+		servers[i], _ = server.NewServerWithConfig(address, i, config)
+	}
+	return servers
+}
+
+// every client issues its puts in order; whichever batch each lands in,
+// the last one must win and every reply must match its request
+func TestBatching(t *testing.T) {
+
+	const serverNum = 3
+	const clientNum = 20
+	const requestEachClient = 10
+	fmt.Printf("Batching Test: %d clients share log entries ...\n", clientNum)
+
+	servers := makeMemCluster(serverNum, 8, 5*time.Millisecond)
+	defer Close(servers)
+
+	finish := make(chan int)
+	for c := 0; c < clientNum; c++ {
+		go func(me int) {
+			defer func() { finish <- 0 }()
+			for i := 0; i < requestEachClient; i++ {
+				args := &server.PutArgs{
+					AgentID:   me,
+					RequestID: int64(i),
+					Key:       "key" + strconv.Itoa(me),
+					Value:     strconv.Itoa(i),
+				}
+				reply := &server.PutReply{}
+				servers[me%serverNum].Put(args, reply)
+				if !reply.OK || reply.AgentID != args.AgentID || reply.RequestID != args.RequestID {
+					t.Errorf("reply %+v does not match request %+v", reply, args)
+				}
+			}
+		}(c)
+	}
+	for c := 0; c < clientNum; c++ {
+		<-finish
+	}
+
+	ag := MakeFakeAgent(servers)
+	for i := 0; i < serverNum; i++ {
+		for c := 0; c < clientNum; c++ {
+			if v := ag.GetFrom("key"+strconv.Itoa(c), i); v != strconv.Itoa(requestEachClient-1) {
+				t.Fatalf("server %v: key%v -> %v, expected %v", i, c, v, requestEachClient-1)
+			}
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// clients are spread over all servers, so fewer, larger entries also
+// mean fewer entries the servers have to compete for
+func benchmarkPut(b *testing.B, maxBatchSize int) {
+	const serverNum = 3
+	const clientNum = 32
+
+	servers := makeMemCluster(serverNum, maxBatchSize, 2*time.Millisecond)
+	defer Close(servers)
+
+	b.ResetTimer()
+	work := make(chan int)
+	finish := make(chan int)
+	for c := 0; c < clientNum; c++ {
+		go func(me int) {
+			defer func() { finish <- 0 }()
+			for i := range work {
+				args := &server.PutArgs{AgentID: me, RequestID: int64(i), Key: "key", Value: strconv.Itoa(i)}
+				servers[me%serverNum].Put(args, &server.PutReply{})
+			}
+		}(c)
+	}
+	for i := 0; i < b.N; i++ {
+		work <- i
+	}
+	close(work)
+	for c := 0; c < clientNum; c++ {
+		<-finish
+	}
+}
+
+func BenchmarkPutUnbatched(b *testing.B) {
+	benchmarkPut(b, 1)
+}
+
+func BenchmarkPutBatched(b *testing.B) {
+	benchmarkPut(b, 64)
+}
@@ -0,0 +1,90 @@
+package tests
+
+import "testing"
+import "server"
+import "transport"
+import "strconv"
+import "fmt"
+import "sync"
+
+// replace server 2 with a new server 3 while clients keep writing; once
+// the change has taken over, servers 0 and 3 are a majority on their own
+func TestReplaceServer(t *testing.T) {
+
+	const serverNum = 3
+	const clientNum = 5
+	fmt.Printf("Membership Test: replace a server under load ...\n")
+
+	var servers []server.Server = make([]server.Server, serverNum+1)
+	var address []string = make([]string, serverNum+1)
+	defer Close(servers)
+
+	network := transport.NewMemNetwork()
+	for i := 0; i <= serverNum; i++ {
+		address[i] = "swap-" + strconv.Itoa(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		servers[i], _ = server.NewServerWithConfig(address[:serverNum], i, &server.Config{Transport: network.Transport()})
+	}
+
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	last := make([]int, clientNum)
+	for c := 0; c < clientNum; c++ {
+		wg.Add(1)
+		go func(me int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				args := &server.PutArgs{AgentID: me, RequestID: int64(i), Key: "key" + strconv.Itoa(me), Value: strconv.Itoa(i)}
+				servers[0].Put(args, &server.PutReply{})
+				last[me] = i
+			}
+		}(c)
+	}
+
+	var err error
+	servers[3], err = server.JoinServer(address[3], address[0], &server.Config{Transport: network.Transport()})
+	if err != nil {
+		t.Fatalf("JoinServer: %v", err)
+	}
+	reply := &server.MembershipReply{}
+	servers[0].RemoveNode(&server.MembershipArgs{address[2]}, reply)
+	if !reply.OK {
+		t.Fatalf("RemoveNode failed")
+	}
+	servers[2].Close()
+	servers[2] = nil
+
+	// every entry up to the switch has to be decided before server 1 goes
+	ag := MakeFakeAgent([]server.Server{servers[0]})
+	for i := 0; i <= server.Alpha; i++ {
+		ag.Put("fence", strconv.Itoa(i))
+	}
+	servers[1].Close()
+	servers[1] = nil
+
+	ag = MakeFakeAgent([]server.Server{servers[3]})
+	for i := 0; i < 10; i++ {
+		ag.Put("after", strconv.Itoa(i))
+	}
+	close(stop)
+	wg.Wait()
+
+	ag = MakeFakeAgent(servers)
+	for _, i := range []int{0, 3} {
+		if v := ag.GetFrom("after", i); v != "9" {
+			t.Fatalf("server %v: after -> %v, expected 9", i, v)
+		}
+		for c := 0; c < clientNum; c++ {
+			if v := ag.GetFrom("key"+strconv.Itoa(c), i); v != strconv.Itoa(last[c]) {
+				t.Fatalf("server %v: key%v -> %v, expected %v", i, c, v, last[c])
+			}
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
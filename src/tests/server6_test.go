@@ -0,0 +1,105 @@
+package tests
+
+import "testing"
+import "server"
+import "transport"
+import "strconv"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strings"
+import "time"
+
+// servers snapshot every few entries, so the text log stays short, and
+// a restart comes back from the snapshot plus the tail of the log
+func TestSnapshotRestart(t *testing.T) {
+
+	const serverNum = 3
+	const snapshotEvery = 10
+	fmt.Printf("Snapshot Test: restart from snapshot and log tail ...\n")
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	defer Close(servers)
+
+	network := transport.NewMemNetwork()
+	for i := 0; i < serverNum; i++ {
+		address[i] = "snap-" + strconv.Itoa(i)
+	}
+	start := func() {
+		for i := 0; i < serverNum; i++ {
+			config := &server.Config{
+				Transport:     network.Transport(),
+				NeedFile:      true,
+				LogDir:        dir,
+				SnapshotEvery: snapshotEvery,
+			}
+			servers[i], err = server.NewServerWithConfig(address, i, config)
+			if err != nil {
+				t.Fatalf("NewServerWithConfig: %v", err)
+			}
+		}
+	}
+	start()
+
+	ag := MakeFakeAgent(servers)
+	for i := 0; i < 35; i++ {
+		ag.Put("key"+strconv.Itoa(i%7), strconv.Itoa(i))
+	}
+
+	for i := 0; i < serverNum; i++ {
+		for servers[i].StorageSize() < 35 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, err := os.Stat(dir + "/snapshot_" + address[i]); err != nil {
+			t.Fatalf("server %v wrote no snapshot: %v", i, err)
+		}
+		log, _ := ioutil.ReadFile(dir + "/log_" + address[i])
+		if lines := strings.Count(string(log), "\n"); lines > snapshotEvery+1 {
+			t.Fatalf("server %v log was not truncated, %v lines", i, lines)
+		}
+	}
+
+	Close(servers)
+	start()
+
+	for i := 0; i < serverNum; i++ {
+		if size := servers[i].StorageSize(); size != 35 {
+			t.Fatalf("server %v applied 35 requests before the restart, %v after", i, size)
+		}
+	}
+	for i := 0; i < serverNum; i++ {
+		for k := 0; k < 7; k++ {
+			if v := ag.GetFrom("key"+strconv.Itoa(k), i); v != strconv.Itoa(28+k) {
+				t.Fatalf("server %v: key%v -> %v, expected %v", i, k, v, 28+k)
+			}
+		}
+	}
+
+	// the text log separates its fields with "::", keys and values may hold it
+	odd := map[string]string{"a::b": "c::d", "e:": ":f", "%3A": "{\"g\"::\"h\"}"}
+	for key, value := range odd {
+		ag.Put(key, value)
+	}
+	for i := 0; i < serverNum; i++ {
+		for servers[i].StorageSize() < 35+len(odd) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	Close(servers)
+	start()
+	for i := 0; i < serverNum; i++ {
+		for key, value := range odd {
+			if v := ag.GetFrom(key, i); v != value {
+				t.Fatalf("server %v: %v -> %v after a restart, expected %v", i, key, v, value)
+			}
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
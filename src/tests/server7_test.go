@@ -0,0 +1,138 @@
+package tests
+
+import "testing"
+import "server"
+import "transport"
+import "strconv"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strings"
+import "time"
+
+// servers 0 and 1 vote and keep data, 2 is a witness and 3, 4 are learners:
+// the witness breaks the tie when a data server is gone, and the learners
+// serve reads from their own copies
+func TestLearnerAndWitness(t *testing.T) {
+
+	const serverNum = 5
+	fmt.Printf("Learner and Witness Test: reads from learners, votes from a witness ...\n")
+
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	defer Close(servers)
+
+	network := transport.NewMemNetwork()
+	for i := 0; i < serverNum; i++ {
+		address[i] = "role-" + strconv.Itoa(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		config := &server.Config{
+			Transport: network.Transport(),
+			Witnesses: address[2:3],
+			Learners:  address[3:],
+		}
+		servers[i], _ = server.NewServerWithConfig(address, i, config)
+	}
+
+	ag := MakeFakeAgent(servers[0:2])
+	reader := MakeFakeAgent(servers)
+	for i := 0; i < 10; i++ {
+		ag.Put("key", strconv.Itoa(i))
+	}
+	for _, i := range []int{3, 4} {
+		for v := reader.GetFrom("key", i); v != "9"; v = reader.GetFrom("key", i) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := servers[2].Put(&server.PutArgs{Key: "key", Value: "w"}, &server.PutReply{}); err == nil {
+		t.Fatalf("a witness took a Put")
+	}
+	if size := servers[2].StorageSize(); size != 0 {
+		t.Fatalf("witness applied %v requests", size)
+	}
+
+	servers[1].Close()
+	servers[1] = nil
+	ag = MakeFakeAgent(servers[0:1])
+	ag.Put("key", "after")
+	for _, i := range []int{3, 4} {
+		for v := reader.GetFrom("key", i); v != "after"; v = reader.GetFrom("key", i) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// learners do not vote, so losing all of them costs no quorum
+	servers[3].Close()
+	servers[4].Close()
+	servers[3], servers[4] = nil, nil
+	done := make(chan bool)
+	go func() {
+		ag.Put("key", "no learners")
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a Put waited for the learners")
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// lastRid returns the log entry of the last line of a server's text log.
+func lastRid(path string) int {
+	text, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(text)), "\n")
+	e := strings.Split(lines[len(lines)-1], "::")
+	rid, err := strconv.Atoi(e[len(e)-1])
+	if err != nil {
+		return -1
+	}
+	return rid
+}
+
+// a witness keeps no data but still logs every entry it applied, so it
+// comes back from a restart where it left off
+func TestWitnessRestart(t *testing.T) {
+
+	const serverNum = 3
+	fmt.Printf("Witness Test: restarted witness resumes at its last entry ...\n")
+
+	dir, err := ioutil.TempDir("", "witness")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	defer Close(servers)
+
+	network := transport.NewMemNetwork()
+	for i := 0; i < serverNum; i++ {
+		address[i] = "witness-" + strconv.Itoa(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		config := &server.Config{
+			Transport:     network.Transport(),
+			Witnesses:     address[2:3],
+			NeedFile:      true,
+			LogDir:        dir,
+			SnapshotEvery: 1000,
+		}
+		servers[i], _ = server.NewServerWithConfig(address, i, config)
+	}
+
+	ag := MakeFakeAgent(servers[0:2])
+	for i := 0; i < 10; i++ {
+		ag.Put("key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	last := lastRid(dir + "/log_" + address[0])
+	for iters := 0; lastRid(dir+"/log_"+address[2]) != last; iters++ {
+		if iters == 100 {
+			t.Fatalf("witness log ends at entry %v, the data servers at %v", lastRid(dir+"/log_"+address[2]), last)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,165 @@
+package tests
+
+import "testing"
+import "server"
+import "sim"
+import "strconv"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "sync/atomic"
+import "time"
+
+// three servers on a simulated network that loses, duplicates, delays
+// and reorders messages; server 2 is partitioned away, crashed and
+// restarted with its files while clients keep writing. A failure prints
+// the seed, and SIM_SEED=<seed> replays the same run.
+func TestSimulatedCluster(t *testing.T) {
+	fmt.Printf("Simulation Test: lossy network, partition, crash and restart ...\n")
+
+	simulateCluster(t, sim.SeedFromEnv())
+	fmt.Printf("  ... Passed\n")
+}
+
+// the scenario of TestSimulatedCluster twice with one seed has to make
+// the scheduler do the very same things
+func TestSimulatedReplay(t *testing.T) {
+	fmt.Printf("Simulation Test: same seed, same trace ...\n")
+
+	seed := sim.SeedFromEnv()
+	first := simulateCluster(t, seed)
+	second := simulateCluster(t, seed)
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i >= len(first) || i >= len(second) || first[i] != second[i] {
+			t.Fatalf("seed %v: traces of %v and %v steps part at step %v:\n%v\n%v", seed, len(first), len(second), i, step(first, i), step(second, i))
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// simulateCluster runs the scenario of TestSimulatedCluster with seed and
+// returns the trace of the simulator.
+func simulateCluster(t *testing.T, seed int64) []string {
+
+	const serverNum = 3
+	const clientNum = 3
+	const putNum = 10
+
+	s := sim.New(seed)
+	defer s.Stop()
+	s.SetFaults(sim.Faults{Loss: 0.05, Duplicate: 0.05, Reorder: 0.3, MaxDelay: 20 * time.Millisecond})
+
+	dir, err := ioutil.TempDir("", "sim")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	defer Close(servers)
+	for i := 0; i < serverNum; i++ {
+		address[i] = "sim-" + strconv.Itoa(i)
+	}
+	start := func(i int) {
+		config := &server.Config{
+			Transport: s.Transport(address[i]),
+			Clock:     s.Clock(),
+			Seed:      s.Int63(),
+			// batches close on the virtual clock, not when the
+			// goroutines of the clients happen to run
+			BatchDelay: time.Millisecond,
+			NeedFile:   true,
+			LogDir:     dir,
+		}
+		var err error
+		servers[i], err = server.NewServerWithConfig(address, i, config)
+		if err != nil {
+			t.Fatalf("%v: NewServerWithConfig: %v", s, err)
+		}
+	}
+	for i := 0; i < serverNum; i++ {
+		start(i)
+	}
+	run := func(what string, done func() bool) {
+		if err := s.Run(done, time.Hour); err != nil {
+			t.Fatalf("%v: %v", what, err)
+		}
+	}
+
+	// clients only talk to servers 0 and 1, which stay up
+	var puts int32
+	for c := 0; c < clientNum; c++ {
+		go func(me int) {
+			for i := 0; i < putNum; i++ {
+				args := &server.PutArgs{AgentID: me, RequestID: int64(i), Key: "key" + strconv.Itoa(me), Value: strconv.Itoa(i)}
+				servers[me%2].Put(args, &server.PutReply{})
+				atomic.AddInt32(&puts, 1)
+			}
+		}(c)
+	}
+	progress := func(n int32) func() bool {
+		return func() bool {
+			return atomic.LoadInt32(&puts) >= n
+		}
+	}
+
+	run("writing", progress(clientNum*putNum/3))
+	s.Partition([]string{address[2]})
+	run("writing with server 2 partitioned", progress(clientNum*putNum*2/3))
+	s.Heal()
+	s.Crash(address[2])
+	servers[2].Close()
+	run("writing with server 2 down", progress(clientNum*putNum))
+
+	s.Restart(address[2])
+	start(2)
+	args := &server.PutArgs{AgentID: clientNum, RequestID: 0, Key: "after", Value: "restart"}
+	go func() {
+		servers[0].Put(args, &server.PutReply{})
+		atomic.AddInt32(&puts, 1)
+	}()
+	run("catching up server 2", func() bool {
+		if atomic.LoadInt32(&puts) <= clientNum*putNum {
+			return false
+		}
+		for i := 0; i < serverNum; i++ {
+			if servers[i].StorageSize() != clientNum*putNum+1 {
+				return false
+			}
+		}
+		return true
+	})
+
+	values := make([]atomic.Value, serverNum*clientNum)
+	var reads int32
+	for i := 0; i < serverNum; i++ {
+		for c := 0; c < clientNum; c++ {
+			go func(i int, c int) {
+				args := &server.GetArgs{AgentID: clientNum + 1 + c, RequestID: int64(i), Key: "key" + strconv.Itoa(c)}
+				reply := &server.GetReply{}
+				servers[i].Get(args, reply)
+				values[i*clientNum+c].Store(reply.Value)
+				atomic.AddInt32(&reads, 1)
+			}(i, c)
+		}
+	}
+	run("reading", func() bool {
+		return atomic.LoadInt32(&reads) == serverNum*clientNum
+	})
+	for i := 0; i < serverNum; i++ {
+		for c := 0; c < clientNum; c++ {
+			if v := values[i*clientNum+c].Load(); v != strconv.Itoa(putNum-1) {
+				t.Fatalf("%v: server %v: key%v -> %v, expected %v", s, i, c, v, putNum-1)
+			}
+		}
+	}
+	return s.Trace()
+}
+
+// step returns step i of trace, for telling where two runs parted.
+func step(trace []string, i int) string {
+	if i >= len(trace) {
+		return "(none)"
+	}
+	return trace[i]
+}
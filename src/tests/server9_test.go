@@ -0,0 +1,84 @@
+package tests
+
+import "testing"
+import "server"
+import "transport"
+import "strconv"
+import "fmt"
+import "reflect"
+import "errors"
+
+// brokenCodec cannot encode anything.
+type brokenCodec struct {
+	server.Codec
+}
+
+func (c brokenCodec) Encode(b server.Batch) ([]byte, error) {
+	return nil, errors.New("broken codec")
+}
+
+// every codec reads back what it wrote, and servers writing different
+// codecs share one log
+func TestCodecs(t *testing.T) {
+
+	const serverNum = 3
+	fmt.Printf("Codec Test: gob, JSON and binary log entries in one cluster ...\n")
+
+	codecs := []server.Codec{server.GobCodec, server.JSONCodec, server.BinaryCodec}
+	batch := server.Batch{Server: 2, BatchID: -7, Requests: []server.Request{
+		{AgentID: 1, RequestID: 1 << 40, Name: "Put", Key: "key", Value: "value"},
+		{AgentID: 0, RequestID: 0, Name: "Get", Key: "", Value: ""},
+		{AgentID: 3, RequestID: 5, Name: "Put", Key: "ключ", Value: "\x00\n"},
+	}}
+	for _, codec := range codecs {
+		data, err := codec.Encode(batch)
+		if err != nil {
+			t.Fatalf("codec %v: Encode: %v", codec.Tag(), err)
+		}
+		decoded, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("codec %v: Decode: %v", codec.Tag(), err)
+		}
+		if !reflect.DeepEqual(decoded, batch) {
+			t.Fatalf("codec %v: decoded %+v, expected %+v", codec.Tag(), decoded, batch)
+		}
+	}
+	if _, err := server.BinaryCodec.Decode([]byte{2, 4}); err == nil {
+		t.Fatalf("binary codec decoded a cut short value")
+	}
+
+	var servers []server.Server = make([]server.Server, serverNum)
+	var address []string = make([]string, serverNum)
+	defer Close(servers)
+
+	network := transport.NewMemNetwork()
+	for i := 0; i < serverNum; i++ {
+		address[i] = "codec-" + strconv.Itoa(i)
+	}
+	for i := 0; i < serverNum; i++ {
+		config := &server.Config{Transport: network.Transport(), Codec: codecs[i]}
+		servers[i], _ = server.NewServerWithConfig(address, i, config)
+	}
+
+	for i := 0; i < serverNum; i++ {
+		ag := MakeFakeAgent(servers[i : i+1])
+		ag.Put("key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	ag := MakeFakeAgent(servers)
+	for i := 0; i < serverNum; i++ {
+		for k := 0; k < serverNum; k++ {
+			if v := ag.GetFrom("key"+strconv.Itoa(k), i); v != strconv.Itoa(k) {
+				t.Fatalf("server %v: key%v -> %v, expected %v", i, k, v, k)
+			}
+		}
+	}
+
+	// a write that could not be encoded never reached the log
+	broken, _ := server.NewServerWithConfig([]string{"codec-broken"}, 0, &server.Config{Transport: network.Transport(), Codec: brokenCodec{server.GobCodec}})
+	defer broken.Close()
+	reply := &server.PutReply{}
+	if err := broken.Put(&server.PutArgs{1, 1, "key", "value"}, reply); err == nil || reply.OK {
+		t.Fatalf("Put through a broken codec succeeded")
+	}
+	fmt.Printf("  ... Passed\n")
+}
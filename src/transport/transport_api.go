@@ -0,0 +1,15 @@
+package transport
+
+import "context"
+import "net"
+
+// Transport carries net/rpc traffic between nodes. Implementations decide
+// how connections are made and whether they are reused.
+type Transport interface {
+	Call(address string, serviceMethod string, args interface{}, reply interface{}) error
+	// CallContext gives up on the call once ctx is done, and ends it
+	// along with the connection it was waiting on.
+	CallContext(ctx context.Context, address string, serviceMethod string, args interface{}, reply interface{}) error
+	Listen(address string) (net.Listener, error)
+	Close() error
+}
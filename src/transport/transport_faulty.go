@@ -0,0 +1,155 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrPartitioned = errors.New("transport: link is partitioned")
+var ErrDropped = errors.New("transport: message dropped")
+var ErrBlackholed = errors.New("transport: no answer from blackholed peer")
+
+// Link says how calls from this node to one peer misbehave. The zero
+// Link is a healthy one. Rules only apply in the direction they are set
+// in, so setting one on a single side gives a one-way partition.
+type Link struct {
+	Drop      float64       // chance the request or its reply is lost
+	Latency   time.Duration // added to every call
+	Partition bool          // calls fail at once, as if refused
+	Blackhole bool          // calls get no answer until the rule is lifted
+}
+
+// Clock is what Faulty needs of a clock to add latency; sim.Clock is one.
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Faulty wraps a transport and injects faults on a per-peer basis. Links
+// can be changed at any time, calls already waiting in a blackhole give
+// up as soon as theirs changes.
+type Faulty struct {
+	inner   Transport
+	lock    sync.Mutex
+	links   map[string]Link
+	random  *rand.Rand
+	clock   Clock
+	changed chan struct{} // closed and replaced whenever a link changes
+}
+
+// NewFaulty wraps inner with healthy links. The seed drives Drop, 0
+// means a fresh one.
+func NewFaulty(inner Transport, seed int64) *Faulty {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Faulty{
+		inner:   inner,
+		links:   make(map[string]Link),
+		random:  rand.New(rand.NewSource(seed)),
+		clock:   wallClock{},
+		changed: make(chan struct{}),
+	}
+}
+
+// SetClock makes Latency pass on clock rather than the wall clock.
+func (f *Faulty) SetClock(clock Clock) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.clock = clock
+}
+
+// SetLink sets the faults of calls to address.
+func (f *Faulty) SetLink(address string, link Link) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if link == (Link{}) {
+		delete(f.links, address)
+	} else {
+		f.links[address] = link
+	}
+	f.wake()
+}
+
+func (f *Faulty) Link(address string) Link {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.links[address]
+}
+
+// Heal makes every link healthy again.
+func (f *Faulty) Heal() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.links = make(map[string]Link)
+	f.wake()
+}
+
+// wake releases the calls waiting in a blackhole; the caller holds lock.
+func (f *Faulty) wake() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *Faulty) Call(address string, serviceMethod string, args interface{}, reply interface{}) error {
+	return f.CallContext(context.Background(), address, serviceMethod, args, reply)
+}
+
+func (f *Faulty) CallContext(ctx context.Context, address string, serviceMethod string, args interface{}, reply interface{}) error {
+	f.lock.Lock()
+	link := f.links[address]
+	changed := f.changed
+	clock := f.clock
+	dropRequest, dropReply := false, false
+	if f.random.Float64() < link.Drop {
+		// half of the lost calls were carried out before the reply got lost
+		dropRequest = f.random.Intn(2) == 0
+		dropReply = !dropRequest
+	}
+	f.lock.Unlock()
+
+	switch {
+	case link.Partition:
+		return ErrPartitioned
+	case link.Blackhole:
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		return ErrBlackholed
+	}
+	if link.Latency > 0 {
+		select {
+		case <-clock.After(link.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if dropRequest {
+		return ErrDropped
+	}
+	err := f.inner.CallContext(ctx, address, serviceMethod, args, reply)
+	if dropReply {
+		return ErrDropped
+	}
+	return err
+}
+
+func (f *Faulty) Listen(address string) (net.Listener, error) {
+	return f.inner.Listen(address)
+}
+
+// Close closes the wrapped transport and releases blackholed calls.
+func (f *Faulty) Close() error {
+	f.Heal()
+	return f.inner.Close()
+}
@@ -0,0 +1,175 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+)
+
+// pooledTransport keeps one persistent rpc.Client per address and
+// redials once when the cached connection turned out to be closed before
+// the request went out.
+type pooledTransport struct {
+	network string
+	dial    func(address string) (net.Conn, error)
+	listen  func(address string) (net.Listener, error)
+	lock    sync.Mutex
+	clients map[string]*pooledClient
+	closed  bool
+}
+
+type pooledClient struct {
+	*rpc.Client
+	dropped bool // closed by the transport, guarded by its lock
+}
+
+// dialTransport opens a fresh connection for every call.
+type dialTransport struct {
+	network string
+}
+
+func newPooledTransport(network string) *pooledTransport {
+	return &pooledTransport{
+		network: network,
+		dial: func(address string) (net.Conn, error) {
+			return net.Dial(network, address)
+		},
+		listen: func(address string) (net.Listener, error) {
+			return net.Listen(network, address)
+		},
+		clients: make(map[string]*pooledClient),
+	}
+}
+
+// NewTCPTransport returns a transport that reuses one TCP connection per peer.
+func NewTCPTransport() Transport {
+	return newPooledTransport("tcp")
+}
+
+// NewUnixTransport returns a transport over Unix-domain sockets. It dials
+// per call, so removing or re-linking a socket file takes effect at once.
+func NewUnixTransport() Transport {
+	return &dialTransport{"unix"}
+}
+
+// Default picks a transport from the shape of an address: file system
+// paths are Unix-domain sockets, anything else is host:port.
+func Default(address string) Transport {
+	if strings.Contains(address, "/") {
+		return NewUnixTransport()
+	}
+	return NewTCPTransport()
+}
+
+func (t *pooledTransport) Call(address string, serviceMethod string, args interface{}, reply interface{}) error {
+	return t.CallContext(context.Background(), address, serviceMethod, args, reply)
+}
+
+func (t *pooledTransport) CallContext(ctx context.Context, address string, serviceMethod string, args interface{}, reply interface{}) error {
+	var err error
+	for try := 0; try < 2; try++ {
+		var c *pooledClient
+		c, err = t.client(address)
+		if err != nil {
+			return err
+		}
+		call := c.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-ctx.Done():
+			// a peer that never answers would hold the call for good;
+			// closing the connection ends it, the next call redials
+			t.drop(address, c)
+			return ctx.Err()
+		}
+		if _, ok := err.(rpc.ServerError); err == nil || ok {
+			return err
+		}
+		// the connection is gone, forget it; unless the transport closed
+		// it under the call, ErrShutdown means the request never went out
+		if t.drop(address, c) || err != rpc.ErrShutdown {
+			// the peer may have carried the request out already, and
+			// calls need not be idempotent
+			return err
+		}
+	}
+	return err
+}
+
+func (t *pooledTransport) client(address string) (*pooledClient, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil, rpc.ErrShutdown
+	}
+	if c, found := t.clients[address]; found {
+		return c, nil
+	}
+	conn, err := t.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	c := &pooledClient{Client: rpc.NewClient(conn)}
+	t.clients[address] = c
+	return c, nil
+}
+
+// drop closes c and takes it out of the pool. It tells whether c had
+// been dropped already.
+func (t *pooledTransport) drop(address string, c *pooledClient) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.clients[address] == c {
+		delete(t.clients, address)
+	}
+	dropped := c.dropped
+	c.dropped = true
+	c.Close()
+	return dropped
+}
+
+func (t *pooledTransport) Listen(address string) (net.Listener, error) {
+	return t.listen(address)
+}
+
+func (t *pooledTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	for address, c := range t.clients {
+		c.dropped = true
+		c.Close()
+		delete(t.clients, address)
+	}
+	return nil
+}
+
+func (t *dialTransport) Call(address string, serviceMethod string, args interface{}, reply interface{}) error {
+	return t.CallContext(context.Background(), address, serviceMethod, args, reply)
+}
+
+func (t *dialTransport) CallContext(ctx context.Context, address string, serviceMethod string, args interface{}, reply interface{}) error {
+	c, err := rpc.Dial(t.network, address)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	call := c.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *dialTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen(t.network, address)
+}
+
+func (t *dialTransport) Close() error {
+	return nil
+}
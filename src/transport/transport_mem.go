@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrNoListener = errors.New("transport: nothing listening on address")
+
+// MemNetwork connects in-memory transports of the same process, so
+// tests can run a cluster without touching real ports.
+type MemNetwork struct {
+	lock      sync.Mutex
+	listeners map[string]*memListener
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{listeners: make(map[string]*memListener)}
+}
+
+// Transport returns a new pooled transport attached to the network.
+func (n *MemNetwork) Transport() Transport {
+	t := newPooledTransport("mem")
+	t.dial = n.dial
+	t.listen = n.listen
+	return t
+}
+
+func (n *MemNetwork) dial(address string) (net.Conn, error) {
+	n.lock.Lock()
+	l, found := n.listeners[address]
+	n.lock.Unlock()
+	if !found {
+		return nil, ErrNoListener
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, ErrNoListener
+	}
+}
+
+func (n *MemNetwork) listen(address string) (net.Listener, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, found := n.listeners[address]; found {
+		return nil, errors.New("transport: address already in use: " + address)
+	}
+	l := &memListener{
+		network: n,
+		address: address,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[address] = l
+	return l, nil
+}
+
+type memListener struct {
+	network *MemNetwork
+	address string
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("transport: listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.network.lock.Lock()
+		if l.network.listeners[l.address] == l {
+			delete(l.network.listeners, l.address)
+		}
+		l.network.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.address)
+}
+
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
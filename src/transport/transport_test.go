@@ -0,0 +1,276 @@
+package transport
+
+import "testing"
+import "net"
+import "net/rpc"
+import "fmt"
+import "strconv"
+import "os"
+import "time"
+import "context"
+
+type Echo struct{}
+
+func (e *Echo) Echo(args *string, reply *string) error {
+	*reply = *args
+	return nil
+}
+
+func serve(t *testing.T, tr Transport, address string) net.Listener {
+	rpcs := rpc.NewServer()
+	rpcs.Register(&Echo{})
+	l, err := tr.Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%v): %v", address, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	return l
+}
+
+func echo(t *testing.T, tr Transport, address string, msg string) {
+	var reply string
+	if err := tr.Call(address, "Echo.Echo", &msg, &reply); err != nil {
+		t.Fatalf("Call(%v): %v", address, err)
+	}
+	if reply != msg {
+		t.Fatalf("wrong reply; got %v expected %v", reply, msg)
+	}
+}
+
+func TestMem(t *testing.T) {
+	fmt.Printf("Test: In-memory transport ...\n")
+
+	network := NewMemNetwork()
+	tr := network.Transport()
+	defer tr.Close()
+
+	l := serve(t, tr, "node-0")
+	for i := 0; i < 10; i++ {
+		echo(t, tr, "node-0", strconv.Itoa(i))
+	}
+
+	var reply string
+	msg := "x"
+	if err := tr.Call("node-1", "Echo.Echo", &msg, &reply); err == nil {
+		t.Fatalf("call to an unknown address succeeded")
+	}
+
+	// a restarted listener is reached through a fresh connection
+	l.Close()
+	tr.Call("node-0", "Echo.Echo", &msg, &reply)
+	l = serve(t, tr, "node-0")
+	defer l.Close()
+	echo(t, tr, "node-0", "again")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a request that may have reached the peer is not sent again
+func TestNoResend(t *testing.T) {
+	fmt.Printf("Test: Broken calls are not retried ...\n")
+
+	network := NewMemNetwork()
+	tr := network.Transport()
+	defer tr.Close()
+	l, err := tr.Listen("node-0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	received := make(chan bool, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// take the request in, then hang up without answering
+			conn.Read(make([]byte, 1<<16))
+			received <- true
+			conn.Close()
+		}
+	}()
+
+	var reply string
+	msg := "x"
+	if err := tr.Call("node-0", "Echo.Echo", &msg, &reply); err == nil {
+		t.Fatalf("call to a peer that hung up succeeded")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(received); n != 1 {
+		t.Fatalf("the peer got the request %v times", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a call given up on ends, and the next one gets a fresh connection
+func TestCallContext(t *testing.T) {
+	fmt.Printf("Test: Calls end with their context ...\n")
+
+	network := NewMemNetwork()
+	tr := network.Transport()
+	defer tr.Close()
+	l, err := tr.Listen("node-0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// take requests in, never answer
+			go conn.Read(make([]byte, 1<<16))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var reply string
+	msg := "x"
+	if err := tr.CallContext(ctx, "node-0", "Echo.Echo", &msg, &reply); err != context.DeadlineExceeded {
+		t.Fatalf("call to a silent peer: %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if n := len(tr.(*pooledTransport).clients); n != 0 {
+		t.Fatalf("the connection of the abandoned call is still pooled")
+	}
+	l.Close()
+	restarted := serve(t, tr, "node-0")
+	defer restarted.Close()
+	echo(t, tr, "node-0", "again")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTCPPool(t *testing.T) {
+	fmt.Printf("Test: Pooled TCP transport reuses connections ...\n")
+
+	tr := NewTCPTransport()
+	defer tr.Close()
+	l := serve(t, tr, "localhost:12999")
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		echo(t, tr, "localhost:12999", strconv.Itoa(i))
+	}
+	if n := len(tr.(*pooledTransport).clients); n != 1 {
+		t.Fatalf("expected a single pooled connection, got %v", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestUnix(t *testing.T) {
+	fmt.Printf("Test: Unix-domain transport ...\n")
+
+	address := "/var/tmp/824-" + strconv.Itoa(os.Getuid()) + "-transport-" + strconv.Itoa(os.Getpid())
+	os.Remove(address)
+	tr := Default(address)
+	defer tr.Close()
+	l := serve(t, tr, address)
+	defer l.Close()
+
+	echo(t, tr, address, "hello")
+
+	// the socket file is gone, so is the peer
+	os.Remove(address)
+	var reply string
+	msg := "x"
+	if err := tr.Call(address, "Echo.Echo", &msg, &reply); err == nil {
+		t.Fatalf("call through a removed socket succeeded")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// instantClock lets every wait pass at once.
+type instantClock struct{}
+
+func (instantClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- time.Now().Add(d)
+	return ch
+}
+
+func TestFaulty(t *testing.T) {
+	fmt.Printf("Test: Per-link fault injection ...\n")
+
+	network := NewMemNetwork()
+	a := NewFaulty(network.Transport(), 1)
+	b := NewFaulty(network.Transport(), 1)
+	defer a.Close()
+	defer b.Close()
+	la := serve(t, a, "a")
+	defer la.Close()
+	lb := serve(t, b, "b")
+	defer lb.Close()
+
+	// one way: a cannot reach b, b still reaches a
+	a.SetLink("b", Link{Partition: true})
+	var reply string
+	msg := "x"
+	if err := a.Call("b", "Echo.Echo", &msg, &reply); err != ErrPartitioned {
+		t.Fatalf("call over a partitioned link: %v", err)
+	}
+	echo(t, b, "a", "back")
+
+	// a blackholed call hangs until its link changes
+	a.SetLink("b", Link{Blackhole: true})
+	done := make(chan error)
+	go func() {
+		done <- a.Call("b", "Echo.Echo", &msg, &reply)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("blackholed call returned: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	a.SetLink("b", Link{})
+	if err := <-done; err != ErrBlackholed {
+		t.Fatalf("released blackholed call: %v", err)
+	}
+	echo(t, a, "b", "healed")
+
+	a.SetLink("b", Link{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	echo(t, a, "b", "slow")
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("latency was not added")
+	}
+
+	// latency ends with the context, and passes on the clock it is given
+	a.SetLink("b", Link{Latency: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.CallContext(ctx, "b", "Echo.Echo", &msg, &reply); err != context.DeadlineExceeded {
+		t.Fatalf("call with an hour of latency: %v, expected %v", err, context.DeadlineExceeded)
+	}
+	a.SetClock(instantClock{})
+	echo(t, a, "b", "an hour later")
+	a.SetClock(wallClock{})
+
+	a.SetLink("b", Link{Drop: 0.5})
+	dropped := 0
+	for i := 0; i < 200; i++ {
+		if err := a.Call("b", "Echo.Echo", &msg, &reply); err == ErrDropped {
+			dropped++
+		}
+	}
+	if dropped < 50 || dropped > 150 {
+		t.Fatalf("%v of 200 calls dropped, expected about 100", dropped)
+	}
+	a.Heal()
+	echo(t, a, "b", "healed")
+
+	fmt.Printf("  ... Passed\n")
+}